@@ -0,0 +1,114 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"reflect"
+)
+
+//
+// Buffer is a byte slice which is seen from lua as a userdata instead of
+// a lua string, so that large payloads are not copied. In lua it has the
+// methods sub, byte, len and tostring, they use the indices of lua
+// strings. A go func returns *Buffer to opt in, and a *Buffer is accepted
+// where a []byte or a string is expected.
+//
+type Buffer struct {
+	data []byte
+}
+
+var typeOfBuffer = reflect.TypeOf((*Buffer)(nil))
+
+func NewBuffer(data []byte) *Buffer {
+	return &Buffer{data: data}
+}
+
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+func (b *Buffer) Len() int {
+	return len(b.data)
+}
+
+func (b *Buffer) String() string {
+	return string(b.data)
+}
+
+//
+// translate lua string indices [i, j] to a go range [from, to)
+//
+func (b *Buffer) luaRange(i, j int) (from, to int) {
+	n := len(b.data)
+	if i < 0 {
+		i += n + 1
+	}
+	if j < 0 {
+		j += n + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > n {
+		j = n
+	}
+	if i > j {
+		return 0, 0
+	}
+	return i - 1, j
+}
+
+//
+// buf:sub(i [, j]) shares the memory of buf
+//
+func (b *Buffer) Sub(i int, j ...int) *Buffer {
+	last := -1
+	if len(j) > 0 {
+		last = j[0]
+	}
+	from, to := b.luaRange(i, last)
+	return &Buffer{data: b.data[from:to]}
+}
+
+//
+// buf:byte([i [, j]]) returns the bytes from i to j like string.byte
+//
+func (b *Buffer) luaByte(state State) int {
+	L := state.L
+	i := 1
+	if C.lua_type(L, 3) == C.LUA_TNUMBER {
+		i = int(C.lua_tointeger(L, 3))
+	}
+	j := i
+	if C.lua_type(L, 4) == C.LUA_TNUMBER {
+		j = int(C.lua_tointeger(L, 4))
+	}
+	from, to := b.luaRange(i, j)
+	C.lua_checkstack(L, C.int(to-from))
+	for k := from; k < to; k++ {
+		C.lua_pushinteger(L, C.lua_Integer(b.data[k]))
+	}
+	return to - from
+}
+
+func (b *Buffer) luaLen() int {
+	return len(b.data)
+}
+
+func (b *Buffer) luaMethods() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":      (*Buffer).Sub,
+		"byte":     (*Buffer).luaByte,
+		"len":      (*Buffer).Len,
+		"tostring": (*Buffer).String,
+	}
+}
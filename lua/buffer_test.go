@@ -0,0 +1,88 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"testing"
+)
+
+type namedByte uint8
+
+type lenCounter struct {
+	N int
+}
+
+func (c *lenCounter) Len() int {
+	return c.N
+}
+
+func TestLua_bytes(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	r.vm.AddFunc("Upper", func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i, c := range b {
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			out[i] = c
+		}
+		return out
+	})
+
+	result = r.E(`
+		local s = Upper("abc\0def")
+		return type(s), s, #s
+	`)
+	expect = []interface{}{"string", "ABC\x00DEF", 7.0}
+	r.AssertEqual(result, expect)
+
+	r.vm.AddFunc("Named", func(b []namedByte) int { return len(b) + int(b[0]) })
+	r.vm.AddFunc("NamedBuffer", func(b []namedByte) int { return len(b) })
+	r.vm.AddFunc("GetBuffer", func() *Buffer { return NewBuffer([]byte("xyz")) })
+	result = r.E(`return Named("\1ab"), NamedBuffer(GetBuffer())`)
+	r.AssertEqual(result, []interface{}{4.0, 3.0})
+
+	// the length operator is not given to every Len method
+	r.vm.AddFunc("Counter", func() *lenCounter { return &lenCounter{3} })
+	r.E_MustError(`return #Counter()`)
+}
+
+func TestLua_buffer(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	packet := []byte("\x01\x02hello")
+	r.vm.AddFunc("GetPacket", func() *Buffer { return NewBuffer(packet) })
+	r.vm.AddFunc("Size", func(b []byte) int { return len(b) })
+	r.vm.AddFunc("Text", func(s string) string { return "<" + s + ">" })
+
+	result = r.E(`
+		local buf = GetPacket()
+		local body = buf:sub(3)
+		return #buf, buf:len(), body:tostring(), body:sub(-3, -2):tostring(), buf:byte(1, 2)
+	`)
+	expect = []interface{}{7.0, 7.0, "hello", "ll", 1.0, 2.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local body = GetPacket():sub(3, 4)
+		return Size(body), Text(body), body:byte(10)
+	`)
+	expect = []interface{}{2.0, "<he>"}
+	r.AssertEqual(result, expect)
+
+	// sub shares the memory
+	r.vm.AddFunc("Touch", func(b []byte) { b[0] = 'H' })
+	r.E(`Touch(GetPacket():sub(3))`)
+	r.AssertEqual(string(packet[2:]), "Hello")
+}
@@ -0,0 +1,214 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+//
+// CallInfo describes a call from lua to a go function for the call
+// hooks. Args and Results are nil for raw functions `func(State) int'.
+//
+type CallInfo struct {
+	Name     string // name given to AddFunc, or the go name of the function
+	Args     []interface{}
+	Results  []interface{}
+	Err      error // failed conversion, panic, or the error result
+	Duration time.Duration
+}
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+func (info *CallInfo) setArgs(t reflect.Type, in []reflect.Value) {
+	info.Args = make([]interface{}, 0, len(in))
+	for i, value := range in {
+		if t.IsVariadic() && i == len(in)-1 {
+			for j := 0; j < value.Len(); j++ {
+				info.Args = append(info.Args, value.Index(j).Interface())
+			}
+			break
+		}
+		if value.IsValid() {
+			info.Args = append(info.Args, value.Interface())
+		} else {
+			info.Args = append(info.Args, nil)
+		}
+	}
+}
+
+func (info *CallInfo) setResults(t reflect.Type, out []reflect.Value) {
+	info.Results = make([]interface{}, len(out))
+	for i, value := range out {
+		info.Results[i] = value.Interface()
+	}
+	if n := len(out); n > 0 && t.Out(n-1) == typeOfError && !out[n-1].IsNil() {
+		info.Err = out[n-1].Interface().(error)
+	}
+}
+
+//
+// observe every call from lua to go functions. before is called with the
+// converted arguments, a non-nil error aborts the call and is raised in
+// lua. after is called when the call is done, also when it failed.
+// Either may be nil.
+//
+func (vm *VM) SetCallHook(before func(info *CallInfo) error, after func(info *CallInfo)) {
+	vm.beforeCall = before
+	vm.afterCall = after
+}
+
+func (vm *VM) callBefore(info *CallInfo) (err error) {
+	if vm.beforeCall == nil {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("call hook error: %v", r)
+		}
+	}()
+	return vm.beforeCall(info)
+}
+
+func (vm *VM) callAfter(info *CallInfo) {
+	if vm.afterCall == nil {
+		return
+	}
+	// a panic must not unwind through lua
+	defer func() {
+		if r := recover(); r != nil {
+			vm.logPanic("call hook", r)
+		}
+	}()
+	vm.afterCall(info)
+}
+
+func (state State) pushFuncToLua(name string, fn interface{}) {
+	ref := state.VM.newRefNode(fn)
+	ref.name = name
+	C.clua_newGoRefUd(state.L, ref.cptr())
+}
+
+func (node *refGo) funcName(v reflect.Value) string {
+	if node.name != "" {
+		return node.name
+	}
+	if f := runtime.FuncForPC(v.Pointer()); f != nil {
+		return f.Name()
+	}
+	return "?"
+}
+
+func (state State) observedCall(node *refGo, v reflect.Value) int {
+	vm := state.VM
+	info := &CallInfo{Name: node.funcName(v)}
+	start := time.Now()
+	ret := state.callGoFunc(v, info)
+	info.Duration = time.Since(start)
+	if m := vm.metrics.Load(); m != nil {
+		m.record(info)
+	}
+	vm.callAfter(info)
+	return ret
+}
+
+//
+// upper bounds of the latency buckets of FuncMetrics, the last bucket
+// counts the slower calls
+//
+var LatencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+//
+// metrics of the calls of a go function from lua
+//
+type FuncMetrics struct {
+	Calls   int64
+	Errors  int64
+	Total   time.Duration
+	Max     time.Duration
+	Latency []int64 // calls per bucket of LatencyBuckets, and the slower ones
+}
+
+type callMetrics struct {
+	mu    sync.Mutex
+	funcs map[string]*FuncMetrics
+}
+
+func (m *callMetrics) record(info *CallInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fm, ok := m.funcs[info.Name]
+	if !ok {
+		fm = &FuncMetrics{Latency: make([]int64, len(LatencyBuckets)+1)}
+		m.funcs[info.Name] = fm
+	}
+	fm.Calls++
+	if info.Err != nil {
+		fm.Errors++
+	}
+	fm.Total += info.Duration
+	if info.Duration > fm.Max {
+		fm.Max = info.Duration
+	}
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if info.Duration <= bound {
+			bucket = i
+			break
+		}
+	}
+	fm.Latency[bucket]++
+}
+
+//
+// collect FuncMetrics of the go functions called from lua, turning it off
+// drops the metrics collected
+//
+func (vm *VM) SetMetrics(on bool) {
+	if !on {
+		vm.metrics.Store(nil)
+	} else if vm.metrics.Load() == nil {
+		vm.metrics.Store(&callMetrics{funcs: make(map[string]*FuncMetrics)})
+	}
+}
+
+//
+// a snapshot of the metrics by function name, it may be called from any
+// goroutine
+//
+func (vm *VM) Metrics() map[string]FuncMetrics {
+	result := make(map[string]FuncMetrics)
+	m := vm.metrics.Load()
+	if m == nil {
+		return result
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, fm := range m.funcs {
+		snapshot := *fm
+		snapshot.Latency = append([]int64(nil), fm.Latency...)
+		result[name] = snapshot
+	}
+	return result
+}
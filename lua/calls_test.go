@@ -0,0 +1,105 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLua_callhook(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.AddFunc("calls.add", func(a, b int) int { return a + b })
+	r.vm.AddFunc("calls.join", func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+	r.vm.AddFunc("calls.fail", func() (int, error) { return 0, errors.New("failed") })
+	r.vm.AddFunc("calls.secret", func() string { return "secret" })
+	r.vm.AddFunc("calls.raw", func(state State) int { return 0 })
+
+	var seen []*CallInfo
+	r.vm.SetCallHook(func(info *CallInfo) error {
+		if info.Name == "calls.secret" {
+			return errors.New("calls.secret is not allowed")
+		}
+		return nil
+	}, func(info *CallInfo) {
+		seen = append(seen, info)
+	})
+	r.vm.SetMetrics(true)
+
+	result := r.E(`
+		local ok, err = pcall(calls.secret)
+		calls.add(1, 2)
+		calls.add(3, 4)
+		calls.raw()
+		return calls.join("-", "a", "b"), ok, err, calls.fail()
+	`)
+	r.AssertEqual(result[0], "a-b")
+	r.AssertEqual(result[1], false)
+	if !strings.Contains(result[2].(string), "not allowed") {
+		t.Errorf("unexpected error %v", result[2])
+	}
+	r.AssertEqual(result[3], 0.0)
+
+	if len(seen) != 6 {
+		t.Fatalf("unexpected calls %v", seen)
+	}
+	r.AssertEqual(seen[0].Name, "calls.secret")
+	r.AssertEqual(seen[0].Results, []interface{}(nil))
+	r.AssertEqual(seen[1].Args, []interface{}{1, 2})
+	r.AssertEqual(seen[1].Results, []interface{}{3})
+	r.AssertEqual(seen[4].Args, []interface{}{"-", "a", "b"})
+	r.AssertEqual(seen[5].Err.Error(), "failed")
+
+	metrics := r.vm.Metrics()
+	add := metrics["calls.add"]
+	r.AssertEqual(add.Calls, int64(2))
+	r.AssertEqual(add.Errors, int64(0))
+	var bucketed int64
+	for _, n := range add.Latency {
+		bucketed += n
+	}
+	r.AssertEqual(bucketed, int64(2))
+	r.AssertEqual(metrics["calls.secret"].Errors, int64(1))
+	r.AssertEqual(metrics["calls.fail"].Errors, int64(1))
+	r.AssertEqual(metrics["calls.raw"].Calls, int64(1))
+
+	r.vm.SetMetrics(false)
+	r.vm.SetCallHook(nil, nil)
+	r.E(`calls.add(1, 2)`)
+	r.AssertEqual(len(seen), 6)
+	r.AssertEqual(len(r.vm.Metrics()), 0)
+}
+
+func TestLua_callhookPanic(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var out bytes.Buffer
+	r.vm.SetLogger(slog.New(slog.NewTextHandler(&out, nil)))
+	r.vm.AddFunc("calls.add", func(a, b int) int { return a + b })
+	r.vm.SetCallHook(nil, func(info *CallInfo) {
+		panic("after hook failed")
+	})
+	r.vm.SetMetrics(true)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			r.vm.Metrics()
+		}
+		done <- true
+	}()
+	result := r.E(`return calls.add(1, 2)`)
+	<-done
+	r.AssertEqual(result, []interface{}{3.0})
+	if !strings.Contains(out.String(), "after hook failed") {
+		t.Errorf("the panic of the hook is not logged: %v", out.String())
+	}
+}
@@ -5,10 +5,14 @@
 #include <string.h>
 #include <lua.h>
 #include <lauxlib.h>
+#include "lobject.h"
+#include "lstate.h"
 #include "clua.h"
 #include "_cgo_export.h"
 
 #define GO_UDATA_META_NAME "go.udata"
+#define GO_UDATA_CACHE_NAME "go.udata.cache"
+#define GO_UDATA_NOPROPS_NAME "go.udata.noprops"
 
 static void * clua_getudata(lua_State *L, int idx, const char *tname) {
 	void *p = lua_touserdata(L, idx);
@@ -19,6 +23,7 @@ static void * clua_getudata(lua_State *L, int idx, const char *tname) {
 				lua_pop(L, 2);  /* remove both metatables */
 				return p;
 			}
+			lua_pop(L, 2);
 		}
 	}
 	return NULL;
@@ -26,6 +31,9 @@ static void * clua_getudata(lua_State *L, int idx, const char *tname) {
 
 void * clua_getGoRef(lua_State *L, int idx) {
 	GoRefUd * ud = (GoRefUd *)clua_getudata(L, idx, GO_UDATA_META_NAME);
+	if (ud == NULL) {
+		return NULL;
+	}
 	return ud->ref;
 }
 
@@ -49,6 +57,23 @@ static int CB__call(lua_State * L) {
 	return 0;
 }
 
+static int CB__closure(lua_State * L) {
+	GoRefUd * ud = (GoRefUd*)lua_touserdata(L, lua_upvalueindex(1));
+	if (ud->ref != NULL) {
+		int ret;
+		// the go function object is at 1, as when it is called by __call
+		lua_pushvalue(L, lua_upvalueindex(1));
+		lua_insert(L, 1);
+		ret = GO_callObject(L, ud->ref);
+		if (ret < 0) {
+			lua_error(L);
+		}
+		return ret;
+	}
+	luaL_error(L, "try to call a detached go object");
+	return 0;
+}
+
 static int CB__index(lua_State * L) {
 	GoRefUd * ud = (GoRefUd*)lua_touserdata(L, 1);
 	if (ud->ref != NULL) {
@@ -151,8 +176,22 @@ static void clua_initGoMeta(lua_State *L) {
 	lua_pop(L,1);
 }
 
+static void clua_initGoCache(lua_State *L) {
+	// registry[GO_UDATA_CACHE_NAME] = setmetatable({}, {__mode = "v"})
+	lua_newtable(L);
+	lua_createtable(L, 0, 1);
+	lua_pushliteral(L, "v");
+	lua_setfield(L, -2, "__mode");
+	lua_setmetatable(L, -2);
+	lua_setfield(L, LUA_REGISTRYINDEX, GO_UDATA_CACHE_NAME);
+}
+
 void clua_initState(lua_State *L) {
 	clua_initGoMeta(L);
+	clua_initGoCache(L);
+	// the environment of userdata without properties
+	lua_newtable(L);
+	lua_setfield(L, LUA_REGISTRYINDEX, GO_UDATA_NOPROPS_NAME);
 }
 
 void clua_newGoRefUd(lua_State *L, void * ref) {
@@ -160,5 +199,174 @@ void clua_newGoRefUd(lua_State *L, void * ref) {
 	ud->ref = ref;
 	luaL_getmetatable(L, GO_UDATA_META_NAME);
 	lua_setmetatable(L, -2);
+	lua_getfield(L, LUA_REGISTRYINDEX, GO_UDATA_NOPROPS_NAME);
+	lua_setfenv(L, -2);
+}
+
+void clua_pushGoClosure(lua_State *L, void * ref, int n) {
+	clua_newGoRefUd(L, ref);
+	lua_insert(L, -n-1);
+	lua_pushcclosure(L, &CB__closure, n + 1);
+}
+
+int clua_pushGoRefProps(lua_State *L, int idx, int create) {
+	if (idx < 0 && idx > LUA_REGISTRYINDEX) {
+		idx = lua_gettop(L) + idx + 1;
+	}
+	if (clua_getudata(L, idx, GO_UDATA_META_NAME) == NULL) {
+		return 0;
+	}
+	// the properties of a go object are kept in the environment of its userdata
+	lua_getfenv(L, idx);
+	lua_getfield(L, LUA_REGISTRYINDEX, GO_UDATA_NOPROPS_NAME);
+	if (!lua_rawequal(L, -1, -2)) {
+		lua_pop(L, 1);
+		return 1;
+	}
+	lua_pop(L, 2);
+	if (!create) {
+		return 0;
+	}
+	lua_newtable(L);
+	lua_pushvalue(L, -1);
+	lua_setfenv(L, idx);
+	return 1;
+}
+
+
+int clua_pushCachedGoRefUd(lua_State *L, void * ref) {
+	lua_getfield(L, LUA_REGISTRYINDEX, GO_UDATA_CACHE_NAME);
+	lua_pushlightuserdata(L, ref);
+	lua_rawget(L, -2);
+	lua_remove(L, -2);
+	if (lua_type(L, -1) == LUA_TUSERDATA) {
+		return 1;
+	}
+	lua_pop(L, 1);
+	return 0;
+}
+
+void clua_newCachedGoRefUd(lua_State *L, void * ref) {
+	clua_newGoRefUd(L, ref);
+	lua_getfield(L, LUA_REGISTRYINDEX, GO_UDATA_CACHE_NAME);
+	lua_pushlightuserdata(L, ref);
+	lua_pushvalue(L, -3);
+	lua_rawset(L, -3);
+	lua_pop(L, 1);
+}
+
+// table access from go runs in protected mode, so that the errors of
+// metamethods do not unwind through go, the table is argument 1
+static int clua_doGettable(lua_State *L) {
+	lua_gettable(L, 1);
+	return 1;
 }
 
+static int clua_doSettable(lua_State *L) {
+	lua_settable(L, 1);
+	return 0;
+}
+
+static int clua_doNext(lua_State *L) {
+	return lua_next(L, 1) ? 2 : 0;
+}
+
+static int clua_absIndex(lua_State *L, int idx) {
+	if (idx < 0 && idx > LUA_REGISTRYINDEX) {
+		return lua_gettop(L) + idx + 1;
+	}
+	return idx;
+}
+
+// t[k] with the key on the top, replaced by the value. On failure the
+// key is replaced by the error and the status of lua_pcall is returned.
+int clua_pgettable(lua_State *L, int idx) {
+	int ret;
+	idx = clua_absIndex(L, idx);
+	lua_pushcfunction(L, &clua_doGettable);
+	lua_pushvalue(L, idx);
+	lua_pushvalue(L, -3);
+	ret = lua_pcall(L, 2, 1, 0);
+	lua_remove(L, -2);
+	return ret;
+}
+
+// t[k] = v with the key and the value on the top, which are popped. On
+// failure they are replaced by the error.
+int clua_psettable(lua_State *L, int idx) {
+	int ret;
+	idx = clua_absIndex(L, idx);
+	lua_pushcfunction(L, &clua_doSettable);
+	lua_pushvalue(L, idx);
+	lua_pushvalue(L, -4);
+	lua_pushvalue(L, -4);
+	ret = lua_pcall(L, 3, 0, 0);
+	if (ret != 0) {
+		lua_insert(L, -3);
+		lua_pop(L, 2);
+		return ret;
+	}
+	lua_pop(L, 2);
+	return 0;
+}
+
+// lua_next with the key on the top, returns 1 with the next key and
+// value, 0 at the end, or -1 with the error instead of the key
+int clua_pnext(lua_State *L, int idx) {
+	int top;
+	idx = clua_absIndex(L, idx);
+	top = lua_gettop(L);
+	lua_pushcfunction(L, &clua_doNext);
+	lua_pushvalue(L, idx);
+	lua_pushvalue(L, top);
+	if (lua_pcall(L, 2, LUA_MULTRET, 0) != 0) {
+		lua_remove(L, top);
+		return -1;
+	}
+	lua_remove(L, top);
+	return lua_gettop(L) >= top ? 1 : 0;
+}
+
+int clua_where(lua_State *L, int level, char *src, size_t n) {
+	lua_Debug ar;
+	if (!lua_getstack(L, level, &ar)) {
+		return -1;
+	}
+	lua_getinfo(L, "Sl", &ar);
+	strncpy(src, ar.short_src, n - 1);
+	src[n - 1] = '\0';
+	return ar.currentline;
+}
+
+#define GO_VM_ID_NAME "go.vm.id"
+
+static void clua_hook(lua_State *L, lua_Debug *ar) {
+	int id;
+	lua_getfield(L, LUA_REGISTRYINDEX, GO_VM_ID_NAME);
+	id = lua_tointeger(L, -1);
+	lua_pop(L, 1);
+	if (id != 0) {
+		GO_luaHook(L, id, ar);
+	}
+}
+
+void clua_setHook(lua_State *L, int id, int mask, int count) {
+	lua_pushinteger(L, id);
+	lua_setfield(L, LUA_REGISTRYINDEX, GO_VM_ID_NAME);
+	lua_sethook(L, mask != 0 ? clua_hook : NULL, mask, count);
+}
+
+static void clua_walkProto(Proto *p, int id) {
+	int i;
+	GO_coverProto(id, (char *)getstr(p->source), p->linedefined, p->lineinfo, p->sizelineinfo);
+	for (i = 0; i < p->sizep; i++) {
+		clua_walkProto(p->p[i], id);
+	}
+}
+
+void clua_coverFunction(lua_State *L, int id) {
+	if (lua_isfunction(L, -1) && !lua_iscfunction(L, -1)) {
+		clua_walkProto(clvalue(L->top - 1)->l.p, id);
+	}
+	lua_pop(L, 1);
+}
@@ -15,7 +15,17 @@ int clua_goPcall(lua_State *L, GoIntf cb);
 void clua_initState(lua_State *L);
 void clua_newGoRefUd(lua_State *L, void * ref);
 void * clua_getGoRef(lua_State *L, int lv);
+int clua_pushCachedGoRefUd(lua_State *L, void * ref);
+void clua_newCachedGoRefUd(lua_State *L, void * ref);
+void clua_pushGoClosure(lua_State *L, void * ref, int n);
+int clua_pushGoRefProps(lua_State *L, int idx, int create);
 int clua_loadProxy(lua_State *L, void *context);
+int clua_pgettable(lua_State *L, int idx);
+int clua_psettable(lua_State *L, int idx);
+int clua_pnext(lua_State *L, int idx);
+int clua_where(lua_State *L, int level, char *src, size_t n);
+void clua_setHook(lua_State *L, int id, int mask, int count);
+void clua_coverFunction(lua_State *L, int id);
 
 #endif
 
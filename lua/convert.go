@@ -14,7 +14,9 @@ import "C"
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"time"
 	"unsafe"
 )
 
@@ -29,10 +31,26 @@ var luaT_typenames = []string{
 var theNullTable *Table
 var theNullFunction *Function
 
+var typeOfTime = reflect.TypeOf(time.Time{})
+var typeOfDuration = reflect.TypeOf(time.Duration(0))
+
 func luaTypeName(ltype C.int) string {
+	if ltype == C.LUA_TNONE {
+		return "no value"
+	}
 	return luaT_typenames[int(ltype)]
 }
 
+func isNumberKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
 func stringToC(str string) (*C.char, C.size_t) {
 	// <HACK> get address and length of go string, to avoid two-times copy
 	pstr := (*reflect.StringHeader)(unsafe.Pointer(&str))
@@ -48,6 +66,26 @@ func stringFromLua(L *C.lua_State, lvalue C.int) string {
 	return C.GoStringN(cs, C.int(cslen))
 }
 
+//
+// the message of the lua error object at lvalue. Strings and numbers are
+// the message, go objects are formatted, and other values are described
+// by their type as the standalone lua interpreter does.
+//
+func (state State) errorStringAt(lvalue C.int) string {
+	L := state.L
+	switch ltype := C.lua_type(L, lvalue); ltype {
+	case C.LUA_TSTRING, C.LUA_TNUMBER:
+		return stringFromLua(L, lvalue)
+	case C.LUA_TUSERDATA:
+		if obj, ok := state.goObjectAt(int(lvalue)); ok {
+			return fmt.Sprint(obj)
+		}
+		fallthrough
+	default:
+		return fmt.Sprintf("(error object is a %s value)", luaTypeName(ltype))
+	}
+}
+
 func pushStringToLua(L *C.lua_State, str string) {
 	s, n := stringToC(str)
 	C.lua_pushlstring(L, s, n)
@@ -60,14 +98,93 @@ func pushBytesToLua(L *C.lua_State, bytes []byte) {
 	C.lua_pushlstring(L, (*C.char)(data), C.size_t(size))
 }
 
+//
+// data as the byte slice type typ, it is copied when the elements are of
+// a named byte type, e.g. []B with `type B uint8'
+//
+func bytesToSlice(data []byte, typ reflect.Type) reflect.Value {
+	v := reflect.ValueOf(data)
+	if v.Type().ConvertibleTo(typ) {
+		return v.Convert(typ)
+	}
+	out := reflect.MakeSlice(typ, len(data), len(data))
+	for i, b := range data {
+		out.Index(i).SetUint(uint64(b))
+	}
+	return out
+}
+
 func (state State) pushObjToLua(obj interface{}) {
 	ref := state.VM.newRefNode(obj)
-	C.clua_newGoRefUd(state.L, unsafe.Pointer(ref))
+	C.clua_newGoRefUd(state.L, ref.cptr())
+}
+
+//
+// push a go pointer or map, the same go object is always mapped to
+// the same userdata as long as the userdata is alive in lua
+//
+func (state State) pushSharedObjToLua(value reflect.Value) {
+	if value.IsNil() {
+		state.pushObjToLua(value.Interface())
+		return
+	}
+	vm := state.VM
+	key := objKey{value.Type(), value.Pointer()}
+	if ref, ok := vm.objCache[key]; ok {
+		if C.clua_pushCachedGoRefUd(state.L, ref.cptr()) != 0 {
+			return
+		}
+	}
+	ref := vm.newRefNode(value.Interface())
+	ref.key = key
+	vm.objCache[key] = ref
+	C.clua_newCachedGoRefUd(state.L, ref.cptr())
+}
+
+//
+// get the go object of a go userdata
+//
+func (state State) goObjectAt(lvalue int) (interface{}, bool) {
+	if C.lua_type(state.L, C.int(lvalue)) != C.LUA_TUSERDATA {
+		return nil, false
+	}
+	ref := C.clua_getGoRef(state.L, C.int(lvalue))
+	if ref == nil {
+		return nil, false
+	}
+	return (*refGo)(ref).obj, true
 }
 
+//
+// push a go value to lua, it panics when a converter fails, so it is only
+// for the callbacks of lua, which turn panics into lua errors
+//
 func (state State) goToLuaValue(value reflect.Value) bool {
+	ok, err := state.pushGoValue(value)
+	if err != nil {
+		panic(err.Error())
+	}
+	return ok
+}
+
+//
+// push a go value to lua, it returns false when the value has no lua
+// representation and nil is pushed instead. When a converter fails,
+// nothing is pushed and the error is returned.
+//
+func (state State) pushGoValue(value reflect.Value) (bool, error) {
 	L := state.L
 	gkind := value.Kind()
+	if state.VM.converters != nil && value.IsValid() {
+		if conv, ok := state.VM.converters[value.Type()]; ok && conv.toLua != nil {
+			return state.pushConverted(conv, value)
+		}
+	}
+	if value.IsValid() && value.Type() == typeOfDuration && !state.VM.durationNanoseconds {
+		// durations are seconds in lua, see SetDurationNanoseconds
+		C.lua_pushnumber(L, C.lua_Number(time.Duration(value.Int()).Seconds()))
+		return true, nil
+	}
 	switch gkind {
 	case reflect.Bool:
 		v := value.Bool()
@@ -76,20 +193,20 @@ func (state State) goToLuaValue(value reflect.Value) bool {
 		} else {
 			C.lua_pushboolean(L, 0)
 		}
-		return true
+		return true, nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		v := value.Int()
 		C.lua_pushinteger(L, C.lua_Integer(v))
-		return true
+		return true, nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		v := value.Uint()
 		C.lua_pushinteger(L, C.lua_Integer(v))
-		return true
+		return true, nil
 	// case reflect.Uintptr:
 	case reflect.Float32, reflect.Float64:
 		v := value.Float()
 		C.lua_pushnumber(L, C.lua_Number(v))
-		return true
+		return true, nil
 
 	// case reflect.Array:
 	// case reflect.Complex64, reflect.Complex128:
@@ -99,28 +216,122 @@ func (state State) goToLuaValue(value reflect.Value) bool {
 		iv := value.Interface()
 		if v, ok := iv.(ILuaRef); ok {
 			v.PushValue(state)
-			return true
+			return true, nil
+		}
+		if value.Type() == typeOfOSFile && !value.IsNil() {
+			state.pushSharedObjToLua(reflect.ValueOf(state.VM.fileOf(iv)))
+			return true, nil
+		}
+		state.pushSharedObjToLua(value)
+		return true, nil
+	case reflect.Map:
+		state.pushSharedObjToLua(value)
+		return true, nil
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			pushBytesToLua(L, value.Bytes())
+			return true, nil
 		}
 		state.pushObjToLua(value.Interface())
-		return true
-	case reflect.Func, reflect.Map, reflect.Slice:
+		return true, nil
+	case reflect.Func:
 		state.pushObjToLua(value.Interface())
-		return true
+		return true, nil
 	case reflect.String:
 		v := value.String()
 		pushStringToLua(L, v)
-		return true
+		return true, nil
 	case reflect.Struct:
 		objPtr := reflect.New(value.Type())
 		objPtr.Elem().Set(value)
 		state.pushObjToLua(objPtr.Interface())
-		return true
+		return true, nil
 		//case reflect.UnsafePointer
 	case reflect.Interface:
-		return state.goToLuaValue(value.Elem())
+		if isStreamType(value.Type()) && !value.IsNil() {
+			// io.Reader and friends are lua files
+			f := state.VM.fileOf(value.Elem().Interface())
+			state.pushSharedObjToLua(reflect.ValueOf(f))
+			return true, nil
+		}
+		return state.pushGoValue(value.Elem())
 	}
 	C.lua_pushnil(L)
-	return false
+	return false, nil
+}
+
+//
+// time.Time from unix seconds, or from a RFC3339 string
+//
+func (state State) luaToGoTime(lvalue C.int) (reflect.Value, bool, error) {
+	L := state.L
+	switch C.lua_type(L, lvalue) {
+	case C.LUA_TNUMBER:
+		sec, frac := math.Modf(float64(C.lua_tonumber(L, lvalue)))
+		t := time.Unix(int64(sec), int64(frac*1e9))
+		return reflect.ValueOf(t), true, nil
+	case C.LUA_TSTRING:
+		t, err := time.Parse(time.RFC3339Nano, stringFromLua(L, lvalue))
+		if err != nil {
+			return reflect.ValueOf(nil), true, err
+		}
+		return reflect.ValueOf(t), true, nil
+	}
+	return reflect.ValueOf(nil), false, nil
+}
+
+//
+// time.Duration from a string like "1m30s", or from seconds, numbers are
+// integer nanoseconds when SetDurationNanoseconds is on
+//
+func (state State) luaToGoDuration(lvalue C.int) (reflect.Value, bool, error) {
+	L := state.L
+	switch C.lua_type(L, lvalue) {
+	case C.LUA_TNUMBER:
+		if state.VM.durationNanoseconds {
+			ns := float64(C.lua_tonumber(L, lvalue))
+			if ns != math.Trunc(ns) {
+				return reflect.ValueOf(nil), true, fmt.Errorf("duration `%v' is not a whole number of nanoseconds", ns)
+			}
+			return reflect.ValueOf(time.Duration(ns)), true, nil
+		}
+		sec := float64(C.lua_tonumber(L, lvalue))
+		d := time.Duration(sec * float64(time.Second))
+		return reflect.ValueOf(d), true, nil
+	case C.LUA_TSTRING:
+		d, err := time.ParseDuration(stringFromLua(L, lvalue))
+		if err != nil {
+			return reflect.ValueOf(nil), true, err
+		}
+		return reflect.ValueOf(d), true, nil
+	}
+	return reflect.ValueOf(nil), false, nil
+}
+
+//
+// convert the lua value to a value of exactly the type typ, nil is the
+// zero value of typ
+//
+func (state State) luaToTypedValue(lvalue int, typ reflect.Type) (reflect.Value, error) {
+	if C.lua_type(state.L, C.int(lvalue)) <= C.LUA_TNIL {
+		return reflect.Zero(typ), nil
+	}
+	value, err := state.luaToGoValue(lvalue, &typ)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if !value.IsValid() {
+		return reflect.Zero(typ), nil
+	}
+	if value.Type() != typ {
+		if !value.Type().AssignableTo(typ) {
+			return reflect.Value{}, fmt.Errorf("can not convert `%v' to `%v'", value.Type(), typ)
+		}
+		v := reflect.New(typ).Elem()
+		v.Set(value)
+		value = v
+	}
+	return value, nil
 }
 
 func (state State) luaToGoValue(_lvalue int, outType *reflect.Type) (reflect.Value, error) {
@@ -130,6 +341,21 @@ func (state State) luaToGoValue(_lvalue int, outType *reflect.Type) (reflect.Val
 	gkind := reflect.Invalid
 	if outType != nil {
 		gkind = (*outType).Kind()
+		if conv, ok := state.VM.converters[*outType]; ok && conv.fromLua != nil {
+			if value, ok, err := state.luaToConverted(conv, lvalue); ok {
+				return value, err
+			}
+		}
+		switch *outType {
+		case typeOfTime:
+			if value, ok, err := state.luaToGoTime(lvalue); ok {
+				return value, err
+			}
+		case typeOfDuration:
+			if value, ok, err := state.luaToGoDuration(lvalue); ok {
+				return value, err
+			}
+		}
 	}
 	switch ltype {
 	case C.LUA_TNONE, C.LUA_TNIL:
@@ -198,6 +424,16 @@ func (state State) luaToGoValue(_lvalue int, outType *reflect.Type) (reflect.Val
 		case reflect.Invalid, reflect.String, reflect.Interface:
 			v := stringFromLua(L, lvalue)
 			return reflect.ValueOf(v), nil
+		case reflect.Slice:
+			if (*outType).Elem().Kind() == reflect.Uint8 {
+				v := []byte(stringFromLua(L, lvalue))
+				return bytesToSlice(v, *outType), nil
+			}
+		case reflect.Ptr:
+			if *outType == typeOfBuffer {
+				v := NewBuffer([]byte(stringFromLua(L, lvalue)))
+				return reflect.ValueOf(v), nil
+			}
 		}
 	case C.LUA_TTABLE:
 		if gkind == reflect.Slice && (*outType).Elem() == typeOfKeyValue {
@@ -207,6 +443,26 @@ func (state State) luaToGoValue(_lvalue int, outType *reflect.Type) (reflect.Val
 			tbl := state.NewLuaTable(int(lvalue))
 			return reflect.ValueOf(tbl), nil
 		}
+		if gkind == reflect.Slice {
+			return state.luaTableToSlice(_lvalue, *outType)
+		}
+		if gkind == reflect.Map {
+			return state.luaTableToMap(_lvalue, *outType)
+		}
+		if gkind == reflect.Struct {
+			ptr := reflect.New(*outType)
+			if err := state.luaTableToStruct(_lvalue, ptr); err != nil {
+				return reflect.ValueOf(nil), err
+			}
+			return ptr.Elem(), nil
+		}
+		if gkind == reflect.Ptr && (*outType).Elem().Kind() == reflect.Struct {
+			ptr := reflect.New((*outType).Elem())
+			if err := state.luaTableToStruct(_lvalue, ptr); err != nil {
+				return reflect.ValueOf(nil), err
+			}
+			return ptr, nil
+		}
 	case C.LUA_TFUNCTION:
 		if gkind == reflect.Invalid || gkind == reflect.Interface || (outType != nil && *outType == reflect.TypeOf(theNullFunction)) {
 			fn := state.NewLuaFunction(int(lvalue))
@@ -232,6 +488,36 @@ func (state State) luaToGoValue(_lvalue int, outType *reflect.Type) (reflect.Val
 						return objValue.Elem(), nil
 					}
 				}
+				// the map or slice of a read-only view
+				if view, ok := obj.(*readOnlyView); ok && view.value.Type().AssignableTo(*outType) {
+					return view.value, nil
+				}
+				// a wrapped stream passed back as itself, e.g. *os.File
+				if f, ok := obj.(*File); ok && f != nil && f.handle != nil {
+					if reflect.TypeOf(f.handle).AssignableTo(*outType) {
+						if err := f.Flush(); err != nil {
+							return reflect.ValueOf(nil), err
+						}
+						// give back what lua has not read yet
+						if err := f.syncReader(); err != nil {
+							return reflect.ValueOf(nil), err
+						}
+						return reflect.ValueOf(f.handle), nil
+					}
+				}
+				// zero-copy buffer passed as bytes
+				if buf, ok := obj.(*Buffer); ok && buf != nil {
+					if gkind == reflect.Slice && (*outType).Elem().Kind() == reflect.Uint8 {
+						return bytesToSlice(buf.data, *outType), nil
+					}
+					if gkind == reflect.String {
+						return reflect.ValueOf(buf.String()).Convert(*outType), nil
+					}
+				}
+				// boxed numbers, e.g. golang.Int32(1) passed as int64
+				if isNumberKind(objType.Kind()) && isNumberKind(gkind) {
+					return objValue.Convert(*outType), nil
+				}
 			}
 		}
 	}
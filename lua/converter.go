@@ -0,0 +1,92 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"fmt"
+	"reflect"
+)
+
+type converter struct {
+	typ     reflect.Type
+	toLua   func(value interface{}) (interface{}, error)
+	fromLua func(value interface{}) (interface{}, error)
+}
+
+//
+// give a go type its own lua representation.
+//
+// toLua gets a value of typ and returns the go value pushed to lua
+// instead, e.g. the string form of an ip address. fromLua gets the lua
+// value converted without a target type (nil, bool, float64, string,
+// *Table, *Function or the go object of a userdata) and returns a value
+// of typ. Either of them can be nil to keep the default conversion in
+// that direction. A userdata which already holds a typ is never passed
+// to fromLua.
+//
+func (vm *VM) RegisterConverter(typ reflect.Type,
+	toLua func(value interface{}) (interface{}, error),
+	fromLua func(value interface{}) (interface{}, error)) {
+	if vm.converters == nil {
+		vm.converters = make(map[reflect.Type]*converter)
+	}
+	if toLua == nil && fromLua == nil {
+		delete(vm.converters, typ)
+		return
+	}
+	vm.converters[typ] = &converter{typ, toLua, fromLua}
+}
+
+func (state State) pushConverted(conv *converter, value reflect.Value) (bool, error) {
+	x, err := conv.toLua(value.Interface())
+	if err != nil {
+		return false, fmt.Errorf("convert `%v' to lua: %v", conv.typ, err)
+	}
+	xv := reflect.ValueOf(x)
+	if xv.IsValid() && xv.Type() == conv.typ {
+		return false, fmt.Errorf("converter of `%v' returns the same type", conv.typ)
+	}
+	return state.pushGoValue(xv)
+}
+
+func (state State) luaToConverted(conv *converter, lvalue C.int) (reflect.Value, bool, error) {
+	if obj, ok := state.goObjectAt(int(lvalue)); ok {
+		typ := reflect.TypeOf(obj)
+		if typ == conv.typ || (typ != nil && typ.Kind() == reflect.Ptr && typ.Elem() == conv.typ) {
+			return reflect.ValueOf(nil), false, nil
+		}
+	}
+	raw, err := state.luaToGoValue(int(lvalue), nil)
+	if err != nil {
+		return raw, true, err
+	}
+	var in interface{}
+	if raw.IsValid() {
+		in = raw.Interface()
+	}
+	x, err := conv.fromLua(in)
+	if err != nil {
+		return reflect.ValueOf(nil), true, fmt.Errorf("convert lua value to `%v': %v", conv.typ, err)
+	}
+	xv := reflect.ValueOf(x)
+	if !xv.IsValid() {
+		return reflect.Zero(conv.typ), true, nil
+	}
+	if !xv.Type().AssignableTo(conv.typ) {
+		if !xv.Type().ConvertibleTo(conv.typ) {
+			return reflect.ValueOf(nil), true,
+				fmt.Errorf("converter of `%v' returns a `%v'", conv.typ, xv.Type())
+		}
+		xv = xv.Convert(conv.typ)
+	}
+	return xv, true, nil
+}
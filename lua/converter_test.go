@@ -0,0 +1,115 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type Cents int64
+
+func (c Cents) String() string {
+	return fmt.Sprintf("%d.%02d", c/100, c%100)
+}
+
+func TestLua_converter(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	r.vm.RegisterConverter(reflect.TypeOf(net.IP{}),
+		func(v interface{}) (interface{}, error) {
+			return v.(net.IP).String(), nil
+		},
+		func(v interface{}) (interface{}, error) {
+			s, _ := v.(string)
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad ip `%v'", v)
+			}
+			return ip, nil
+		})
+	r.vm.RegisterConverter(reflect.TypeOf(Cents(0)),
+		func(v interface{}) (interface{}, error) {
+			return v.(Cents).String(), nil
+		},
+		func(v interface{}) (interface{}, error) {
+			f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+			return Cents(f*100 + 0.5), err
+		})
+
+	r.vm.AddFunc("Loopback", func() net.IP { return net.IPv4(127, 0, 0, 1) })
+	r.vm.AddFunc("IsLoopback", func(ip net.IP) bool { return ip.IsLoopback() })
+	r.vm.AddFunc("AddCents", func(a, b Cents) Cents { return a + b })
+
+	result = r.E(`
+		return Loopback(), IsLoopback("127.0.0.2"), IsLoopback("8.8.8.8")
+	`)
+	expect = []interface{}{"127.0.0.1", true, false}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		return AddCents("1.25", 2.5)
+	`)
+	expect = []interface{}{"3.75"}
+	r.AssertEqual(result, expect)
+
+	r.E_MustError(`IsLoopback("localhost")`)
+}
+
+func TestLua_stringer(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	r.vm.AddFunc("GetCents", func() *Cents { c := Cents(1234); return &c })
+	r.vm.AddFunc("GetError", func() error { return fmt.Errorf("boom") })
+	r.vm.AddFunc("GetInts", NewIntSlice)
+
+	result = r.E(`
+		return tostring(GetCents()), tostring(GetError()), tostring(golang.Int(5)):sub(1, 10)
+	`)
+	expect = []interface{}{"12.34", "boom", "go object:"}
+	r.AssertEqual(result, expect)
+}
+
+type badConverted int
+
+func TestLua_converterError(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.RegisterConverter(reflect.TypeOf(badConverted(0)),
+		func(v interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("bad value %v", v)
+		}, nil)
+	r.vm.AddFunc("GetBad", func() badConverted { return 1 })
+
+	result := r.E(`
+		local ok, err = pcall(GetBad)
+		return ok, err, function(a, b) return a end
+	`)
+	r.AssertEqual(result[0], false)
+	if !strings.Contains(result[1].(string), "bad value 1") {
+		t.Errorf("unexpected error %v", result[1])
+	}
+
+	fn := result[2].(*Function)
+	state := State{r.vm, r.vm.globalL}
+	top := state.Gettop()
+	if _, err := fn.Call(1, badConverted(2)); err == nil || !strings.Contains(err.Error(), "bad value 2") {
+		t.Errorf("unexpected error %v", err)
+	}
+	r.AssertEqual(state.Gettop(), top)
+}
@@ -0,0 +1,212 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+//
+// Coverage collects the executed lines of named lua chunks, see
+// VM.EvalNamedString. It may be shared by several VMs, also running in
+// different goroutines, to merge their results.
+//
+type Coverage struct {
+	mu    sync.Mutex
+	files map[string]map[int]int64 // chunk -> line -> count
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{files: make(map[string]map[int]int64)}
+}
+
+type coverKey struct {
+	chunk string
+	line  int
+}
+
+type coverState struct {
+	cov  *Coverage
+	seen map[coverKey]bool // functions whose lines are known
+}
+
+//
+// the name of a chunk from the source of a function, chunks loaded
+// without a name, like EvalString, are not covered
+//
+func chunkName(source *C.char) (string, bool) {
+	s := C.GoString(source)
+	if len(s) == 0 || (s[0] != '@' && s[0] != '=') {
+		return "", false
+	}
+	return s[1:], true
+}
+
+func (cov *Coverage) lines(chunk string) map[int]int64 {
+	lines, ok := cov.files[chunk]
+	if !ok {
+		lines = make(map[int]int64)
+		cov.files[chunk] = lines
+	}
+	return lines
+}
+
+func (cov *Coverage) hit(chunk string, line int) {
+	cov.mu.Lock()
+	cov.lines(chunk)[line]++
+	cov.mu.Unlock()
+}
+
+//export GO_coverProto
+func GO_coverProto(id int, source *C.char, linedefined C.int, lineinfo *C.int, n C.int) {
+	vm := hookVM(id)
+	if vm == nil || vm.cover == nil {
+		return
+	}
+	chunk, ok := chunkName(source)
+	if !ok {
+		return
+	}
+	vm.cover.seen[coverKey{chunk, int(linedefined)}] = true
+
+	cov := vm.cover.cov
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+	lines := cov.lines(chunk)
+	if n > 0 {
+		for _, line := range unsafe.Slice((*C.int)(lineinfo), int(n)) {
+			if _, ok := lines[int(line)]; !ok {
+				lines[int(line)] = 0
+			}
+		}
+	}
+}
+
+//
+// record the lines run by vm into cov until StopCoverage. Lines of a
+// chunk which are never run are reported once any function of the chunk
+// is called.
+//
+func (vm *VM) StartCoverage(cov *Coverage) error {
+	if vm.cover != nil {
+		return errors.New("lua coverage already in use")
+	}
+	vm.cover = &coverState{cov: cov, seen: make(map[coverKey]bool)}
+	vm.updateHook()
+	return nil
+}
+
+func (vm *VM) StopCoverage() {
+	vm.cover = nil
+	vm.updateHook()
+}
+
+//
+// the lines of chunk with their counts, lines never run have count 0
+//
+func (cov *Coverage) Lines(chunk string) map[int]int64 {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+	result := make(map[int]int64)
+	for line, count := range cov.files[chunk] {
+		result[line] = count
+	}
+	return result
+}
+
+//
+// the names of the covered chunks, sorted
+//
+func (cov *Coverage) Chunks() []string {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+	chunks := make([]string, 0, len(cov.files))
+	for chunk := range cov.files {
+		chunks = append(chunks, chunk)
+	}
+	sort.Strings(chunks)
+	return chunks
+}
+
+//
+// add the counts of other to cov
+//
+func (cov *Coverage) Merge(other *Coverage) {
+	for _, chunk := range other.Chunks() {
+		lines := other.Lines(chunk)
+		cov.mu.Lock()
+		dst := cov.lines(chunk)
+		for line, count := range lines {
+			dst[line] += count
+		}
+		cov.mu.Unlock()
+	}
+}
+
+func sortedLines(lines map[int]int64) []int {
+	result := make([]int, 0, len(lines))
+	for line := range lines {
+		result = append(result, line)
+	}
+	sort.Ints(result)
+	return result
+}
+
+//
+// write the coverage as a lcov tracefile
+//
+func (cov *Coverage) WriteLcov(w io.Writer) error {
+	for _, chunk := range cov.Chunks() {
+		lines := cov.Lines(chunk)
+		if _, err := fmt.Fprintf(w, "TN:\nSF:%v\n", chunk); err != nil {
+			return err
+		}
+		hit := 0
+		for _, line := range sortedLines(lines) {
+			if lines[line] > 0 {
+				hit++
+			}
+			if _, err := fmt.Fprintf(w, "DA:%v,%v\n", line, lines[line]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "LF:%v\nLH:%v\nend_of_record\n", len(lines), hit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// write the coverage as a go cover profile in count mode, one block for
+// every line
+//
+func (cov *Coverage) WriteGoCover(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "mode: count"); err != nil {
+		return err
+	}
+	for _, chunk := range cov.Chunks() {
+		lines := cov.Lines(chunk)
+		for _, line := range sortedLines(lines) {
+			_, err := fmt.Fprintf(w, "%v:%v.1,%v.0 1 %v\n", chunk, line, line+1, lines[line])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
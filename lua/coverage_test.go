@@ -0,0 +1,77 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const coverRules = `function check(x)
+	if x > 10 then
+		return "big"
+	end
+	return "small"
+end
+`
+
+func TestLua_coverage(t *testing.T) {
+	cov := NewCoverage()
+	run := func(x int) {
+		vm := NewVM()
+		defer vm.Close()
+		vm.Openlibs()
+		if err := vm.StartCoverage(cov); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vm.EvalNamedString("rules.lua", coverRules); err != nil {
+			t.Fatal(err)
+		}
+		vm.EvalString(fmt.Sprintf("check(%v)", x))
+		vm.StopCoverage()
+		vm.EvalString(fmt.Sprintf("check(%v)", x))
+	}
+
+	run(20)
+	lines := cov.Lines("rules.lua")
+	if lines[2] != 1 || lines[3] != 1 {
+		t.Errorf("unexpected counts %v", lines)
+	}
+	if count, ok := lines[5]; !ok || count != 0 {
+		t.Errorf("line 5 must be reported as not run: %v", lines)
+	}
+
+	run(1)
+	lines = cov.Lines("rules.lua")
+	if lines[2] != 2 || lines[3] != 1 || lines[5] != 1 {
+		t.Errorf("unexpected merged counts %v", lines)
+	}
+	if chunks := cov.Chunks(); len(chunks) != 1 || chunks[0] != "rules.lua" {
+		t.Errorf("unexpected chunks %v", chunks)
+	}
+
+	other := NewCoverage()
+	other.Merge(cov)
+	other.Merge(cov)
+	if other.Lines("rules.lua")[2] != 4 {
+		t.Errorf("merge must add counts: %v", other.Lines("rules.lua"))
+	}
+
+	var lcov, gocover bytes.Buffer
+	cov.WriteLcov(&lcov)
+	cov.WriteGoCover(&gocover)
+	for _, want := range []string{"SF:rules.lua\n", "DA:2,2\n", "DA:5,1\n", "end_of_record\n"} {
+		if !strings.Contains(lcov.String(), want) {
+			t.Errorf("%q not in %q", want, lcov.String())
+		}
+	}
+	for _, want := range []string{"mode: count\n", "rules.lua:2.1,3.0 1 2\n"} {
+		if !strings.Contains(gocover.String(), want) {
+			t.Errorf("%q not in %q", want, gocover.String())
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+//
+// the debug adapter protocol, see
+// https://microsoft.github.io/debug-adapter-protocol/specification
+//
+// lua runs in a single thread for the client
+//
+const dapThreadID = 1
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapConn struct {
+	c      net.Conn
+	reader *bufio.Reader
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newDapConn(c net.Conn) *dapConn {
+	return &dapConn{c: c, reader: bufio.NewReader(c)}
+}
+
+func (conn *dapConn) close() {
+	conn.c.Close()
+}
+
+func (conn *dapConn) read() (*dapRequest, error) {
+	header, err := textproto.NewReader(conn.reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length: %v", err)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(conn.reader, body); err != nil {
+		return nil, err
+	}
+	req := new(dapRequest)
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (conn *dapConn) send(msg map[string]interface{}) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.seq++
+	msg["seq"] = conn.seq
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(conn.c, "Content-Length: %v\r\n\r\n%s", len(body), body)
+}
+
+func (conn *dapConn) event(name string, body interface{}) {
+	msg := map[string]interface{}{"type": "event", "event": name}
+	if body != nil {
+		msg["body"] = body
+	}
+	conn.send(msg)
+}
+
+func (conn *dapConn) respond(req *dapRequest, body interface{}, err error) {
+	msg := map[string]interface{}{
+		"type":        "response",
+		"request_seq": req.Seq,
+		"command":     req.Command,
+		"success":     err == nil,
+	}
+	if err != nil {
+		msg["message"] = err.Error()
+	}
+	if body != nil {
+		msg["body"] = body
+	}
+	conn.send(msg)
+}
+
+//
+// serve one client until it disconnects, clients are served one at a time
+//
+func (d *debugger) serve(conn *dapConn) {
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+	defer d.detach(conn)
+	defer conn.close()
+
+	for {
+		req, err := conn.read()
+		if err != nil {
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := d.dispatch(req)
+		conn.respond(req, body, err)
+		switch req.Command {
+		case "initialize":
+			conn.event("initialized", nil)
+		case "disconnect":
+			return
+		}
+	}
+}
+
+func (d *debugger) dispatch(req *dapRequest) (interface{}, error) {
+	var args struct {
+		Source struct {
+			Name string `json:"name"`
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+		StartFrame         int    `json:"startFrame"`
+		Levels             int    `json:"levels"`
+		FrameID            int    `json:"frameId"`
+		VariablesReference int    `json:"variablesReference"`
+		Expression         string `json:"expression"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch", "attach", "configurationDone", "disconnect":
+		return nil, nil
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{"breakpoints": []interface{}{}}, nil
+	case "setBreakpoints":
+		path := args.Source.Path
+		if path == "" {
+			path = args.Source.Name
+		}
+		lines := make([]int, 0, len(args.Breakpoints))
+		verified := make([]map[string]interface{}, 0, len(args.Breakpoints))
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+			verified = append(verified, map[string]interface{}{"verified": true, "line": bp.Line})
+		}
+		d.setBreakpoints(path, lines)
+		return map[string]interface{}{"breakpoints": verified}, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []interface{}{map[string]interface{}{"id": dapThreadID, "name": "lua"}},
+		}, nil
+	case "continue":
+		d.resume(stepNone)
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	case "next":
+		d.resume(stepOver)
+		return nil, nil
+	case "stepIn":
+		d.resume(stepIn)
+		return nil, nil
+	case "stepOut":
+		d.resume(stepOut)
+		return nil, nil
+	case "pause":
+		d.requestPause()
+		return nil, nil
+	}
+
+	// requests inspecting the stopped VM
+	var body interface{}
+	var err error
+	var fn func(state State)
+	switch req.Command {
+	case "stackTrace":
+		fn = func(state State) {
+			frames := d.stackTrace(state)
+			total := len(frames)
+			if args.StartFrame < len(frames) {
+				frames = frames[args.StartFrame:]
+			} else {
+				frames = nil
+			}
+			if args.Levels > 0 && args.Levels < len(frames) {
+				frames = frames[:args.Levels]
+			}
+			if frames == nil {
+				frames = []debugFrame{}
+			}
+			body = map[string]interface{}{"stackFrames": frames, "totalFrames": total}
+		}
+	case "scopes":
+		fn = func(state State) {
+			body = map[string]interface{}{"scopes": d.scopes(args.FrameID - 1)}
+		}
+	case "variables":
+		fn = func(state State) {
+			var vars []debugVariable
+			vars, err = d.variables(state, args.VariablesReference)
+			if vars == nil {
+				vars = []debugVariable{}
+			}
+			body = map[string]interface{}{"variables": vars}
+		}
+	case "evaluate":
+		fn = func(state State) {
+			level := args.FrameID - 1
+			if level < 0 {
+				level = 0
+			}
+			var v debugVariable
+			v, err = d.evaluate(state, args.Expression, level)
+			body = map[string]interface{}{
+				"result":             v.Value,
+				"type":               v.Type,
+				"variablesReference": v.VariablesReference,
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported request `%v'", req.Command)
+	}
+	if rerr := d.run(fn); rerr != nil {
+		return nil, rerr
+	}
+	return body, err
+}
@@ -0,0 +1,646 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <stdlib.h>
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+
+static int clua_getinfoDbgS(lua_State *L, lua_Debug *ar) {
+	return lua_getinfo(L, "S", ar);
+}
+
+static int clua_getinfoDbgSln(lua_State *L, lua_Debug *ar) {
+	return lua_getinfo(L, "Sln", ar);
+}
+
+static int clua_getinfoDbgf(lua_State *L, lua_Debug *ar) {
+	return lua_getinfo(L, "f", ar);
+}
+
+static void clua_setIndexField(lua_State *L, int idx) {
+	lua_setfield(L, idx, "__index");
+}
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+//
+// a request of the debug client run by the goroutine of the VM while it
+// is stopped, a nil fn resumes the VM with the given step mode
+//
+type debugCmd struct {
+	fn   func(state State)
+	step stepMode
+	done chan struct{}
+}
+
+type handleKind int
+
+const (
+	handleLocals handleKind = iota
+	handleUpvalues
+	handleGlobals
+	handleLua
+	handleGo
+)
+
+//
+// a variables reference of the client, valid until the VM resumes
+//
+type debugHandle struct {
+	kind  handleKind
+	level int
+	lref  C.int
+	value reflect.Value
+}
+
+type debugVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type debugger struct {
+	vm       *VM
+	listener net.Listener
+
+	mu          sync.Mutex
+	conn        *dapConn
+	breakpoints map[string]map[int]bool // source path -> lines
+	bpLines     map[int]int             // line -> number of sources
+	pause       bool
+	stopped     bool
+
+	cmds chan debugCmd
+
+	// owned by the goroutine of the VM
+	step      stepMode
+	stepDepth int
+	handles   []debugHandle
+}
+
+//
+// serve the debug adapter protocol on addr for editors to attach, e.g.
+// "127.0.0.1:4711". Only loopback addresses are accepted, clients can
+// run any lua code. It returns the address listened on.
+//
+// While a client is stopped at a breakpoint the goroutine running the
+// lua code of vm is blocked. StartDebugger and StopDebugger must be
+// called from the goroutine owning vm.
+//
+func (vm *VM) StartDebugger(addr string) (net.Addr, error) {
+	if vm.debugger != nil {
+		return nil, errors.New("lua debugger already started")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("debugger address `%v' is not a loopback address", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &debugger{
+		vm:          vm,
+		listener:    l,
+		breakpoints: make(map[string]map[int]bool),
+		bpLines:     make(map[int]int),
+		cmds:        make(chan debugCmd),
+	}
+	vm.debugger = d
+	vm.updateHook()
+	go d.accept()
+	return l.Addr(), nil
+}
+
+//
+// stop listening and disconnect the client
+//
+func (vm *VM) StopDebugger() error {
+	d := vm.debugger
+	if d == nil {
+		return errors.New("lua debugger not started")
+	}
+	vm.debugger = nil
+	vm.updateHook()
+	err := d.listener.Close()
+	d.mu.Lock()
+	conn := d.conn
+	d.mu.Unlock()
+	if conn != nil {
+		conn.close()
+	}
+	return err
+}
+
+func (d *debugger) accept() {
+	for {
+		c, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		d.serve(newDapConn(c))
+	}
+}
+
+//
+// forget the client, and let the VM run
+//
+func (d *debugger) detach(conn *dapConn) {
+	d.mu.Lock()
+	if d.conn == conn {
+		d.conn = nil
+		d.breakpoints = make(map[string]map[int]bool)
+		d.bpLines = make(map[int]int)
+		d.pause = false
+	}
+	d.mu.Unlock()
+	d.resume(stepNone)
+}
+
+func (d *debugger) setBreakpoints(path string, lines []int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for line := range d.breakpoints[path] {
+		d.bpLines[line]--
+		if d.bpLines[line] == 0 {
+			delete(d.bpLines, line)
+		}
+	}
+	delete(d.breakpoints, path)
+	if len(lines) == 0 {
+		return
+	}
+	set := make(map[int]bool)
+	for _, line := range lines {
+		if !set[line] {
+			set[line] = true
+			d.bpLines[line]++
+		}
+	}
+	d.breakpoints[path] = set
+}
+
+//
+// whether the chunk has a breakpoint at line, the path of a breakpoint
+// sent by an editor is usually absolute, and matches the chunk name as a
+// suffix
+//
+func (d *debugger) hasBreakpoint(chunk string, line int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for path, lines := range d.breakpoints {
+		if !lines[line] {
+			continue
+		}
+		if path == chunk || strings.HasSuffix(path, "/"+strings.TrimPrefix(chunk, "./")) {
+			return true
+		}
+	}
+	return false
+}
+
+func stackDepth(L *C.lua_State) int {
+	var ar C.lua_Debug
+	depth := 0
+	for C.lua_getstack(L, C.int(depth), &ar) != 0 {
+		depth++
+	}
+	return depth
+}
+
+//
+// the line hook of the debugger
+//
+func (d *debugger) line(state State, ar *C.lua_Debug) {
+	line := int(ar.currentline)
+	d.mu.Lock()
+	attached := d.conn != nil
+	pause := d.pause
+	d.pause = false
+	maybeBreak := d.bpLines[line] > 0
+	d.mu.Unlock()
+	if !attached {
+		d.step = stepNone
+		return
+	}
+
+	reason := ""
+	switch {
+	case pause:
+		reason = "pause"
+	case d.step == stepIn,
+		d.step == stepOver && stackDepth(state.L) <= d.stepDepth,
+		d.step == stepOut && stackDepth(state.L) < d.stepDepth:
+		reason = "step"
+	case maybeBreak:
+		C.clua_getinfoDbgS(state.L, ar)
+		if chunk, ok := chunkName(ar.source); ok && d.hasBreakpoint(chunk, line) {
+			reason = "breakpoint"
+		}
+	}
+	if reason != "" {
+		d.stop(state, reason)
+	}
+}
+
+//
+// block the VM, and serve the requests of the client until it resumes
+//
+func (d *debugger) stop(state State, reason string) {
+	d.step = stepNone
+	d.mu.Lock()
+	d.stopped = true
+	conn := d.conn
+	if conn == nil {
+		d.stopped = false
+	}
+	d.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	conn.event("stopped", map[string]interface{}{
+		"reason":            reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	})
+
+	for cmd := range d.cmds {
+		if cmd.fn != nil {
+			cmd.fn(state)
+			close(cmd.done)
+			continue
+		}
+		d.step = cmd.step
+		if d.step != stepNone {
+			d.stepDepth = stackDepth(state.L)
+		}
+		break
+	}
+	for _, h := range d.handles {
+		if h.lref != 0 {
+			C.luaL_unref(state.L, C.LUA_REGISTRYINDEX, h.lref)
+		}
+	}
+	d.handles = nil
+}
+
+//
+// run fn on the goroutine of the stopped VM
+//
+func (d *debugger) run(fn func(state State)) error {
+	d.mu.Lock()
+	stopped := d.stopped
+	d.mu.Unlock()
+	if !stopped {
+		return errors.New("lua is not stopped")
+	}
+	cmd := debugCmd{fn: fn, done: make(chan struct{})}
+	d.cmds <- cmd
+	<-cmd.done
+	return nil
+}
+
+func (d *debugger) resume(step stepMode) {
+	d.mu.Lock()
+	stopped := d.stopped
+	d.stopped = false
+	d.mu.Unlock()
+	if stopped {
+		d.cmds <- debugCmd{step: step}
+	}
+}
+
+func (d *debugger) requestPause() {
+	d.mu.Lock()
+	d.pause = true
+	d.mu.Unlock()
+}
+
+func (d *debugger) newHandle(h debugHandle) int {
+	d.handles = append(d.handles, h)
+	return len(d.handles)
+}
+
+func (d *debugger) handle(ref int) (debugHandle, bool) {
+	if ref <= 0 || ref > len(d.handles) {
+		return debugHandle{}, false
+	}
+	return d.handles[ref-1], true
+}
+
+type debugFrame struct {
+	ID     int                    `json:"id"`
+	Name   string                 `json:"name"`
+	Source map[string]interface{} `json:"source,omitempty"`
+	Line   int                    `json:"line"`
+	Column int                    `json:"column"`
+}
+
+func (d *debugger) stackTrace(state State) []debugFrame {
+	var frames []debugFrame
+	var ar C.lua_Debug
+	for level := 0; C.lua_getstack(state.L, C.int(level), &ar) != 0; level++ {
+		C.clua_getinfoDbgSln(state.L, &ar)
+		src := C.GoString(&ar.short_src[0])
+		frame := debugFrame{
+			ID:     level + 1,
+			Name:   frameName(&ar, src),
+			Line:   int(ar.currentline),
+			Column: 1,
+		}
+		if chunk, ok := chunkName(ar.source); ok && C.GoString(ar.what) != "C" {
+			frame.Source = map[string]interface{}{"name": chunk, "path": chunk}
+		}
+		if frame.Line < 0 {
+			frame.Line = 0
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func (d *debugger) scopes(level int) []map[string]interface{} {
+	scope := func(name string, kind handleKind, expensive bool) map[string]interface{} {
+		return map[string]interface{}{
+			"name":               name,
+			"variablesReference": d.newHandle(debugHandle{kind: kind, level: level}),
+			"expensive":          expensive,
+		}
+	}
+	return []map[string]interface{}{
+		scope("Locals", handleLocals, false),
+		scope("Upvalues", handleUpvalues, false),
+		scope("Globals", handleGlobals, true),
+	}
+}
+
+//
+// describe the lua value at idx
+//
+func (d *debugger) variable(state State, name string, idx C.int) debugVariable {
+	L := state.L
+	ltype := C.lua_type(L, idx)
+	v := debugVariable{Name: name, Type: luaTypeName(ltype)}
+	switch ltype {
+	case C.LUA_TNIL:
+		v.Value = "nil"
+	case C.LUA_TBOOLEAN:
+		v.Value = strconv.FormatBool(C.lua_toboolean(L, idx) != 0)
+	case C.LUA_TNUMBER:
+		v.Value = strconv.FormatFloat(float64(C.lua_tonumber(L, idx)), 'g', 14, 64)
+	case C.LUA_TSTRING:
+		v.Value = strconv.Quote(stringFromLua(L, idx))
+	case C.LUA_TTABLE:
+		v.Value = fmt.Sprintf("table: %p", C.lua_topointer(L, idx))
+		C.lua_pushvalue(L, idx)
+		lref := C.luaL_ref(L, C.LUA_REGISTRYINDEX)
+		v.VariablesReference = d.newHandle(debugHandle{kind: handleLua, lref: lref})
+	case C.LUA_TUSERDATA:
+		if obj, ok := state.goObjectAt(int(idx)); ok {
+			return d.goVariable(state, name, reflect.ValueOf(obj))
+		}
+		v.Value = fmt.Sprintf("userdata: %p", C.lua_topointer(L, idx))
+	default:
+		v.Value = fmt.Sprintf("%v: %p", v.Type, C.lua_topointer(L, idx))
+	}
+	return v
+}
+
+//
+// format a go value, the methods of user types like String may panic
+//
+func formatGoValue(value reflect.Value) (s string) {
+	defer func() {
+		if r := recover(); r != nil {
+			s = fmt.Sprintf("<panic: %v>", r)
+		}
+	}()
+	return fmt.Sprintf("%v", value.Interface())
+}
+
+//
+// describe a go value, structs are shown through the fields seen by lua
+//
+func (d *debugger) goVariable(state State, name string, value reflect.Value) debugVariable {
+	if !value.IsValid() {
+		return debugVariable{Name: name, Value: "nil"}
+	}
+	v := debugVariable{Name: name, Type: value.Type().String()}
+	s := formatGoValue(value)
+	if len(s) > 120 {
+		s = s[:117] + "..."
+	}
+	v.Value = s
+	elem := value
+	for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface {
+		if elem.IsNil() {
+			return v
+		}
+		elem = elem.Elem()
+	}
+	switch elem.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		v.VariablesReference = d.newHandle(debugHandle{kind: handleGo, value: elem})
+	}
+	return v
+}
+
+const maxDebugChildren = 1000
+
+func (d *debugger) goChildren(state State, value reflect.Value) []debugVariable {
+	var vars []debugVariable
+	switch value.Kind() {
+	case reflect.Struct:
+		sinfo := state.VM.registerStruct(value.Type())
+		names := make([]string, 0, len(sinfo.fields))
+		for name, fld := range sinfo.fields {
+			if fld.typ == DATA_FIELD {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fvalue := value.FieldByIndex(sinfo.fields[name].dataIndex)
+			vars = append(vars, d.goVariable(state, name, fvalue))
+		}
+	case reflect.Slice, reflect.Array:
+		base := state.VM.indexBaseOf(value.Type())
+		for i := 0; i < value.Len() && i < maxDebugChildren; i++ {
+			vars = append(vars, d.goVariable(state, strconv.Itoa(i+base), value.Index(i)))
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() && len(vars) < maxDebugChildren {
+			vars = append(vars, d.goVariable(state, fmt.Sprint(iter.Key().Interface()), iter.Value()))
+		}
+		sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	}
+	return vars
+}
+
+func (d *debugger) tableChildren(state State, tidx C.int) []debugVariable {
+	L := state.L
+	var vars []debugVariable
+	C.lua_pushnil(L)
+	for C.lua_next(L, tidx) != 0 && len(vars) < maxDebugChildren {
+		var name string
+		if C.lua_type(L, -2) == C.LUA_TSTRING {
+			name = stringFromLua(L, -2)
+		} else {
+			name = "[" + d.variable(state, "", -2).Value + "]"
+		}
+		vars = append(vars, d.variable(state, name, -1))
+		C.lua_settop(L, -2) // pop the value
+	}
+	C.lua_settop(L, tidx)
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
+
+func (d *debugger) variables(state State, ref int) ([]debugVariable, error) {
+	L := state.L
+	h, ok := d.handle(ref)
+	if !ok {
+		return nil, fmt.Errorf("invalid variables reference %v", ref)
+	}
+	bottom := C.lua_gettop(L)
+	defer C.lua_settop(L, bottom)
+
+	var vars []debugVariable
+	var ar C.lua_Debug
+	switch h.kind {
+	case handleLocals:
+		if C.lua_getstack(L, C.int(h.level), &ar) == 0 {
+			return nil, fmt.Errorf("invalid frame %v", h.level+1)
+		}
+		for i := 1; ; i++ {
+			cname := C.lua_getlocal(L, &ar, C.int(i))
+			if cname == nil {
+				break
+			}
+			if name := C.GoString(cname); !strings.HasPrefix(name, "(") {
+				vars = append(vars, d.variable(state, name, -1))
+			}
+			C.lua_settop(L, -2)
+		}
+	case handleUpvalues:
+		if C.lua_getstack(L, C.int(h.level), &ar) == 0 {
+			return nil, fmt.Errorf("invalid frame %v", h.level+1)
+		}
+		C.clua_getinfoDbgf(L, &ar)
+		for i := 1; ; i++ {
+			cname := C.lua_getupvalue(L, -1, C.int(i))
+			if cname == nil {
+				break
+			}
+			vars = append(vars, d.variable(state, C.GoString(cname), -1))
+			C.lua_settop(L, -2)
+		}
+	case handleGlobals:
+		C.lua_pushvalue(L, C.LUA_GLOBALSINDEX)
+		vars = d.tableChildren(state, C.lua_gettop(L))
+	case handleLua:
+		C.lua_rawgeti(L, C.LUA_REGISTRYINDEX, h.lref)
+		vars = d.tableChildren(state, C.lua_gettop(L))
+	case handleGo:
+		vars = d.goChildren(state, h.value)
+	}
+	return vars, nil
+}
+
+//
+// evaluate expr where the function at level can see the locals and
+// upvalues of the function, and its globals
+//
+func (d *debugger) evaluate(state State, expr string, level int) (debugVariable, error) {
+	L := state.L
+	bottom := C.lua_gettop(L)
+	defer C.lua_settop(L, bottom)
+
+	var ar C.lua_Debug
+	hasFrame := C.lua_getstack(L, C.int(level), &ar) != 0
+
+	// env = setmetatable({}, {__index = getfenv(f)})
+	C.lua_createtable(L, 0, 0)
+	env := C.lua_gettop(L)
+	C.lua_createtable(L, 0, 1)
+	if hasFrame {
+		C.clua_getinfoDbgf(L, &ar)
+		C.lua_getfenv(L, -1)
+		C.lua_remove(L, -2)
+	} else {
+		C.lua_pushvalue(L, C.LUA_GLOBALSINDEX)
+	}
+	C.clua_setIndexField(L, -2)
+	C.lua_setmetatable(L, env)
+
+	if hasFrame {
+		C.clua_getinfoDbgf(L, &ar)
+		for i := 1; ; i++ {
+			cname := C.lua_getupvalue(L, -1, C.int(i))
+			if cname == nil {
+				break
+			}
+			C.lua_setfield(L, env, cname)
+		}
+		C.lua_settop(L, -2)
+		for i := 1; ; i++ {
+			cname := C.lua_getlocal(L, &ar, C.int(i))
+			if cname == nil {
+				break
+			}
+			if C.GoString(cname)[0] == '(' {
+				C.lua_settop(L, -2)
+				continue
+			}
+			C.lua_setfield(L, env, cname)
+		}
+	}
+
+	chunkname := C.CString("=eval")
+	defer C.free(unsafe.Pointer(chunkname))
+	s, n := stringToC("return " + expr)
+	if C.luaL_loadbuffer(L, s, n, chunkname) != 0 {
+		C.lua_settop(L, -2)
+		s, n = stringToC(expr)
+		if C.luaL_loadbuffer(L, s, n, chunkname) != 0 {
+			return debugVariable{}, errors.New(stringFromLua(L, -1))
+		}
+	}
+	C.lua_pushvalue(L, env)
+	C.lua_setfenv(L, -2)
+	if C.lua_pcall(L, 0, 1, 0) != 0 {
+		return debugVariable{}, errors.New(stringFromLua(L, -1))
+	}
+	return d.variable(state, expr, -1), nil
+}
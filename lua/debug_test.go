@@ -0,0 +1,225 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dapTestClient struct {
+	t      *testing.T
+	c      net.Conn
+	reader *bufio.Reader
+	seq    int
+}
+
+func (client *dapTestClient) send(command string, args interface{}) int {
+	client.seq++
+	body, _ := json.Marshal(map[string]interface{}{
+		"seq": client.seq, "type": "request", "command": command, "arguments": args,
+	})
+	fmt.Fprintf(client.c, "Content-Length: %v\r\n\r\n%s", len(body), body)
+	return client.seq
+}
+
+func (client *dapTestClient) read() map[string]interface{} {
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := textproto.NewReader(client.reader).ReadMIMEHeader()
+	if err != nil {
+		client.t.Fatalf("read header: %v", err)
+	}
+	n, _ := strconv.Atoi(header.Get("Content-Length"))
+	body := make([]byte, n)
+	if _, err := io.ReadFull(client.reader, body); err != nil {
+		client.t.Fatalf("read body: %v", err)
+	}
+	var msg map[string]interface{}
+	json.Unmarshal(body, &msg)
+	return msg
+}
+
+//
+// send a request, and return the body of its response, skipping events
+//
+func (client *dapTestClient) call(command string, args interface{}) map[string]interface{} {
+	seq := client.send(command, args)
+	for {
+		msg := client.read()
+		if msg["type"] == "response" && int(msg["request_seq"].(float64)) == seq {
+			if msg["success"] != true {
+				client.t.Fatalf("%v failed: %v", command, msg["message"])
+			}
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+func (client *dapTestClient) waitEvent(event string) map[string]interface{} {
+	for {
+		msg := client.read()
+		if msg["type"] == "event" && msg["event"] == event {
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+func (client *dapTestClient) variables(ref interface{}) map[string]map[string]interface{} {
+	body := client.call("variables", map[string]interface{}{"variablesReference": ref})
+	result := make(map[string]map[string]interface{})
+	for _, v := range body["variables"].([]interface{}) {
+		v := v.(map[string]interface{})
+		result[v["name"].(string)] = v
+	}
+	return result
+}
+
+type debugPoint struct {
+	X, Y int
+}
+
+const debugScript = `local function twice(n)
+	return n * 2
+end
+local p = point
+local x = twice(21)
+local y = x + 1
+return y
+`
+
+func TestLua_debugger(t *testing.T) {
+	vm := NewVM()
+	defer vm.Close()
+	vm.Openlibs()
+	vm.AddStructList(debugPoint{})
+	vm.AddFunc("getpoint", func() *debugPoint { return &debugPoint{3, 4} })
+	vm.EvalString("point = getpoint()")
+
+	if _, err := vm.StartDebugger("0.0.0.0:0"); err == nil {
+		t.Errorf("a non-loopback address must be rejected")
+	}
+	addr, err := vm.StartDebugger("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	client := &dapTestClient{t: t, c: c, reader: bufio.NewReader(c)}
+
+	caps := client.call("initialize", map[string]interface{}{"adapterID": "lua"})
+	if caps["supportsConfigurationDoneRequest"] != true {
+		t.Errorf("unexpected capabilities %v", caps)
+	}
+	client.waitEvent("initialized")
+	bps := client.call("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "/src/scripts/debug.lua"},
+		"breakpoints": []interface{}{map[string]interface{}{"line": 5}},
+	})
+	if len(bps["breakpoints"].([]interface{})) != 1 {
+		t.Errorf("unexpected breakpoints %v", bps)
+	}
+	client.call("configurationDone", nil)
+
+	done := make(chan []interface{})
+	go func() {
+		result, err := vm.EvalNamedString("scripts/debug.lua", debugScript)
+		if err != nil {
+			t.Errorf("eval: %v", err)
+		}
+		done <- result
+	}()
+
+	stopped := client.waitEvent("stopped")
+	if stopped["reason"] != "breakpoint" {
+		t.Errorf("unexpected stop %v", stopped)
+	}
+	trace := client.call("stackTrace", map[string]interface{}{"threadId": 1})
+	frame := trace["stackFrames"].([]interface{})[0].(map[string]interface{})
+	if frame["line"].(float64) != 5 || frame["source"].(map[string]interface{})["name"] != "scripts/debug.lua" {
+		t.Errorf("unexpected frame %v", frame)
+	}
+
+	scopes := client.call("scopes", map[string]interface{}{"frameId": frame["id"]})
+	locals := scopes["scopes"].([]interface{})[0].(map[string]interface{})
+	vars := client.variables(locals["variablesReference"])
+	p, ok := vars["p"]
+	if !ok || p["type"] != "*lua.debugPoint" {
+		t.Fatalf("unexpected locals %v", vars)
+	}
+	fields := client.variables(p["variablesReference"])
+	if fields["X"]["value"] != "3" || fields["Y"]["value"] != "4" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+
+	eval := client.call("evaluate", map[string]interface{}{"expression": "twice(p.X) + 1", "frameId": frame["id"]})
+	if eval["result"] != "7" {
+		t.Errorf("unexpected evaluation %v", eval)
+	}
+
+	// step into twice, out of it, and over the next line
+	client.call("stepIn", map[string]interface{}{"threadId": 1})
+	client.waitEvent("stopped")
+	trace = client.call("stackTrace", map[string]interface{}{"threadId": 1})
+	frame = trace["stackFrames"].([]interface{})[0].(map[string]interface{})
+	if frame["line"].(float64) != 2 {
+		t.Errorf("step in stopped at %v", frame)
+	}
+	client.call("stepOut", map[string]interface{}{"threadId": 1})
+	client.waitEvent("stopped")
+	client.call("next", map[string]interface{}{"threadId": 1})
+	client.waitEvent("stopped")
+	trace = client.call("stackTrace", map[string]interface{}{"threadId": 1})
+	frame = trace["stackFrames"].([]interface{})[0].(map[string]interface{})
+	vars = client.variables(client.call("scopes", map[string]interface{}{"frameId": frame["id"]})["scopes"].([]interface{})[0].(map[string]interface{})["variablesReference"])
+	if vars["x"]["value"] != "42" {
+		t.Errorf("unexpected locals after stepping %v at %v", vars, frame)
+	}
+
+	client.call("continue", map[string]interface{}{"threadId": 1})
+	result := <-done
+	if len(result) != 1 || result[0] != 43.0 {
+		t.Errorf("unexpected result %v", result)
+	}
+
+	client.call("disconnect", nil)
+	if err := vm.StopDebugger(); err != nil {
+		t.Error(err)
+	}
+}
+
+type panickyStringer struct {
+	N int
+}
+
+func (p *panickyStringer) String() string {
+	panic("String() failed")
+}
+
+func TestLua_debugFormatPanic(t *testing.T) {
+	d := &debugger{}
+	v := d.goVariable(State{}, "p", reflect.ValueOf(&panickyStringer{}))
+	if !strings.Contains(v.Value, "String() failed") {
+		t.Errorf("unexpected value %v", v.Value)
+	}
+	var nilp *panickyStringer
+	v = d.goVariable(State{}, "nilp", reflect.ValueOf(nilp))
+	if v.Value != "<nil>" {
+		t.Errorf("unexpected value %v", v.Value)
+	}
+}
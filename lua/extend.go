@@ -0,0 +1,113 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"reflect"
+)
+
+//
+// the type whose extension applies to values of typ, pointers to
+// structs and slices share the extension of what they point to
+//
+func extendedTypeOf(typ reflect.Type) reflect.Type {
+	if typ.Kind() == reflect.Ptr {
+		switch typ.Elem().Kind() {
+		case reflect.Struct, reflect.Slice:
+			return typ.Elem()
+		}
+	}
+	return typ
+}
+
+//
+// push the member key of the go object being indexed, which is at 1 in
+// the __index callback, from its properties and then from the lua
+// extension of its type. It returns false and pushes nothing if neither
+// has the member.
+//
+func (state State) indexExtension(typ reflect.Type, lkey C.int) bool {
+	L := state.L
+	if C.clua_pushGoRefProps(L, 1, 0) != 0 {
+		C.lua_pushvalue(L, lkey)
+		C.lua_rawget(L, -2)
+		C.lua_remove(L, -2)
+		if C.lua_type(L, -1) != C.LUA_TNIL {
+			return true
+		}
+		C.lua_settop(L, -2)
+	}
+	ref, ok := state.VM.extends[extendedTypeOf(typ)]
+	if !ok {
+		return false
+	}
+	C.lua_rawgeti(L, C.LUA_REGISTRYINDEX, ref)
+	C.lua_pushvalue(L, lkey)
+	C.lua_rawget(L, -2)
+	C.lua_remove(L, -2)
+	if C.lua_type(L, -1) != C.LUA_TNIL {
+		return true
+	}
+	C.lua_settop(L, -2)
+	return false
+}
+
+//
+// golang.Extend(typeName, methods) makes the members of the table methods
+// visible on the go objects of the type, e.g.
+//
+//	golang.Extend("Point", {Length = function(self) ... end})
+//
+// Go fields and methods hide the members of the same name. Structs and
+// slices can be extended, and the pointers to them share the extension.
+// Extending a type again replaces its table.
+//
+func luaExtend(state State) int {
+	L := state.L
+	if C.lua_type(L, 2) != C.LUA_TSTRING || C.lua_type(L, 3) != C.LUA_TTABLE {
+		return pushNilAndError(L, "Extend() needs a type name and a table")
+	}
+	vm := state.VM
+	typ, err := vm.typeByName(stringFromLua(L, 2))
+	if err != nil {
+		return pushNilAndError(L, "%v", err)
+	}
+	typ = extendedTypeOf(typ)
+	if k := typ.Kind(); k != reflect.Struct && k != reflect.Slice {
+		return pushNilAndError(L, "Extend() only apply to `struct' or `slice', got `%v'", typ)
+	}
+
+	if vm.extends == nil {
+		vm.extends = make(map[reflect.Type]C.int)
+	}
+	if ref, ok := vm.extends[typ]; ok {
+		C.luaL_unref(L, C.LUA_REGISTRYINDEX, ref)
+	}
+	C.lua_pushvalue(L, 3)
+	vm.extends[typ] = C.luaL_ref(L, C.LUA_REGISTRYINDEX)
+	C.lua_pushvalue(L, 3)
+	return 1
+}
+
+//
+// golang.Props(obj) is the table of lua properties of a go object, created
+// on first use. Members of the table are visible on the object when it
+// has no go field of the same name. The table lives as long as the
+// userdata of the object.
+//
+func luaProps(state State) int {
+	L := state.L
+	if C.clua_pushGoRefProps(L, 2, 1) == 0 {
+		return pushNilAndError(L, "Props() only apply to go object")
+	}
+	return 1
+}
@@ -0,0 +1,57 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLua_extend(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.AddType("Point", reflect.TypeOf(Point{}))
+	r.vm.AddFunc("extend.points", func() []Point { return []Point{{1, 2}, {3, 4}} })
+
+	result := r.E(`
+		golang.Extend("Point", {
+			Scale = function(self, n) self.X = self.X * n; self.Y = self.Y * n; return self end,
+			SumXY = function(self) return 0 end,
+		})
+		golang.Extend("[]Point", {
+			Total = function(self)
+				local n = 0
+				for i = 0, #self - 1 do n = n + self[i]:SumXY() end
+				return n
+			end,
+		})
+		local p = golang.New("Point", {X = 1, Y = 2}):Scale(3)
+		return p.X, p.Y, p:SumXY(), extend.points():Total()
+	`)
+	r.AssertEqual(result, []interface{}{3.0, 6.0, 9.0, 10.0})
+
+	r.E_MustError(`return golang.New("Point").Missing`)
+	result = r.E(`return golang.Extend("int", {})`)
+	r.AssertEqual(result[0], nil)
+}
+
+func TestLua_props(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	p := &Point{1, 2}
+	r.vm.AddFunc("props.point", func() *Point { return p })
+
+	result := r.E(`
+		local p = props.point()
+		local ok = pcall(function() return p.tag end)
+		golang.Props(p).tag = "origin"
+		golang.Props(p).X = 100
+		return ok, props.point().tag, p.X, golang.Props(props.point()).tag, golang.Props(1)
+	`)
+	r.AssertEqual(result, []interface{}{false, "origin", 1.0, "origin", nil, "Props() only apply to go object"})
+	r.E_MustError(`props.point().tag = 1`)
+}
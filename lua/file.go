@@ -0,0 +1,515 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+//
+// File is a lua file handle backed by go io interfaces. In lua it has
+// the methods of lua files: read, write, lines, seek, flush, setvbuf and
+// close. In go it is an io.ReadWriteCloser sharing the buffers with lua.
+//
+type File struct {
+	handle interface{}
+	reader *bufio.Reader
+	writer io.Writer
+	wbuf   *bufio.Writer // nil when writes are not buffered
+	wmode  string
+	closed bool
+	owned  bool // opened by lua, closed when collected
+	vm     *VM  // set when the file is cached by VM.fileOf
+}
+
+//
+// wrap handle as a lua file, handle is any of io.Reader, io.Writer,
+// io.Seeker and io.Closer. Reads are buffered, writes are not until
+// f:setvbuf("full") or f:setvbuf("line") is called from lua.
+//
+// Values of the interface types of package io and *os.File are wrapped
+// automatically when they are passed to lua, e.g. as results of go
+// functions. Pass NewFile(r) to wrap values whose static type is lost,
+// like the arguments of Function.Call.
+//
+func NewFile(handle interface{}) *File {
+	f := &File{handle: handle, wmode: "no"}
+	if r, ok := handle.(io.Reader); ok {
+		f.reader = bufio.NewReader(r)
+	}
+	if w, ok := handle.(io.Writer); ok {
+		f.writer = w
+	}
+	return f
+}
+
+//
+// the lua file of a go stream, the same stream gets the same file as
+// long as lua holds it, so buffered data is not lost between two
+// accesses
+//
+func (vm *VM) fileOf(handle interface{}) *File {
+	if f, ok := handle.(*File); ok {
+		return f
+	}
+	if reflect.TypeOf(handle).Kind() != reflect.Ptr {
+		return NewFile(handle)
+	}
+	if f, ok := vm.files[handle]; ok {
+		return f
+	}
+	f := NewFile(handle)
+	f.vm = vm
+	vm.files[handle] = f
+	return f
+}
+
+//
+// whether a value of type typ is passed to lua as a file
+//
+func isStreamType(typ reflect.Type) bool {
+	if typ == typeOfOSFile {
+		return true
+	}
+	return typ.Kind() == reflect.Interface && typ.PkgPath() == "io" &&
+		(typ.Implements(typeOfReader) || typ.Implements(typeOfWriter))
+}
+
+var (
+	typeOfOSFile = reflect.TypeOf((*os.File)(nil))
+	typeOfReader = reflect.TypeOf((*io.Reader)(nil)).Elem()
+	typeOfWriter = reflect.TypeOf((*io.Writer)(nil)).Elem()
+)
+
+func (f *File) String() string {
+	if f.closed {
+		return "file (closed)"
+	}
+	return fmt.Sprintf("file (%p)", f)
+}
+
+func (f *File) luaMethods() map[string]interface{} {
+	return map[string]interface{}{
+		"read":    (*File).luaRead,
+		"write":   (*File).luaWrite,
+		"lines":   (*File).luaLines,
+		"seek":    (*File).luaSeek,
+		"flush":   (*File).luaFlush,
+		"setvbuf": (*File).luaSetvbuf,
+		"close":   (*File).luaClose,
+	}
+}
+
+func (f *File) luaFinalize() {
+	if !f.closed {
+		if f.owned {
+			f.close()
+		} else {
+			f.Flush()
+		}
+	}
+	if f.vm != nil && f.vm.files[f.handle] == f {
+		delete(f.vm.files, f.handle)
+	}
+}
+
+func (f *File) checkOpen() {
+	if f.closed {
+		panic("attempt to use a closed file")
+	}
+}
+
+//
+// drop the read buffer, moving the underlying position back to the
+// position seen from lua
+//
+func (f *File) syncReader() error {
+	if f.reader == nil || f.reader.Buffered() == 0 {
+		return nil
+	}
+	seeker, ok := f.handle.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	if _, err := seeker.Seek(int64(-f.reader.Buffered()), io.SeekCurrent); err != nil {
+		return err
+	}
+	f.reader.Reset(f.handle.(io.Reader))
+	return nil
+}
+
+//
+// write p, honoring the buffering mode set by setvbuf
+//
+func (f *File) write(p []byte) (int, error) {
+	if err := f.syncReader(); err != nil {
+		return 0, err
+	}
+	if f.wbuf == nil {
+		return f.writer.Write(p)
+	}
+	n, err := f.wbuf.Write(p)
+	if err == nil && f.wmode == "line" && bytes.IndexByte(p, '\n') >= 0 {
+		err = f.wbuf.Flush()
+	}
+	return n, err
+}
+
+//
+// Read reads through the read buffer of the file
+//
+func (f *File) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.reader == nil {
+		return 0, errNotReadable
+	}
+	if err := f.Flush(); err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+//
+// Write writes through the write buffer of the file
+//
+func (f *File) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.writer == nil {
+		return 0, errNotWritable
+	}
+	return f.write(p)
+}
+
+//
+// Flush writes the buffered data to the underlying writer
+//
+func (f *File) Flush() error {
+	if f.wbuf == nil {
+		return nil
+	}
+	return f.wbuf.Flush()
+}
+
+//
+// Close flushes the file and closes the underlying stream if it is an
+// io.Closer
+//
+func (f *File) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.close()
+}
+
+var (
+	errNotReadable = errors.New("file is not readable")
+	errNotWritable = errors.New("file is not writable")
+)
+
+func pushFileResult(L *C.lua_State, err error) int {
+	C.lua_pushnil(L)
+	pushStringToLua(L, err.Error())
+	return 2
+}
+
+func (f *File) readLine() (string, bool) {
+	line, err := f.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false
+	}
+	return strings.TrimSuffix(line, "\n"), true
+}
+
+//
+// push the result of a read format, false at end of file
+//
+func (f *File) readFormat(state State, lformat int) bool {
+	L := state.L
+	if C.lua_type(L, C.int(lformat)) == C.LUA_TNUMBER {
+		n := int(C.lua_tointeger(L, C.int(lformat)))
+		if n <= 0 {
+			if _, err := f.reader.Peek(1); err != nil {
+				return false
+			}
+			pushStringToLua(L, "")
+			return true
+		}
+		buf := make([]byte, n)
+		k, _ := io.ReadFull(f.reader, buf)
+		if k == 0 {
+			return false
+		}
+		pushBytesToLua(L, buf[:k])
+		return true
+	}
+
+	format := strings.TrimPrefix(stringFromLua(L, C.int(lformat)), "*")
+	if format == "" {
+		panic("bad argument to 'read' (invalid format)")
+	}
+	switch format[0] {
+	case 'n':
+		var x float64
+		if _, err := fmt.Fscan(f.reader, &x); err != nil {
+			return false
+		}
+		C.lua_pushnumber(L, C.lua_Number(x))
+	case 'a':
+		data, _ := io.ReadAll(f.reader)
+		pushBytesToLua(L, data)
+	case 'l':
+		line, ok := f.readLine()
+		if !ok {
+			return false
+		}
+		pushStringToLua(L, line)
+	default:
+		panic("bad argument to 'read' (invalid format)")
+	}
+	return true
+}
+
+//
+// f:read(...) with the formats "*n", "*a", "*l" or a number of bytes
+//
+func (f *File) luaRead(state State) int {
+	L := state.L
+	f.checkOpen()
+	if f.reader == nil {
+		return pushFileResult(L, errNotReadable)
+	}
+	if err := f.Flush(); err != nil {
+		return pushFileResult(L, err)
+	}
+	top := int(C.lua_gettop(L))
+	if top < 3 {
+		pushStringToLua(L, "*l")
+		top = 3
+	}
+	C.lua_checkstack(L, C.int(top))
+	n := 0
+	for i := 3; i <= top; i++ {
+		n++
+		if !f.readFormat(state, i) {
+			C.lua_pushnil(L)
+			break
+		}
+	}
+	return n
+}
+
+//
+// f:write(...) writes strings and numbers, and returns f
+//
+func (f *File) luaWrite(state State) int {
+	L := state.L
+	f.checkOpen()
+	if f.writer == nil {
+		return pushFileResult(L, errNotWritable)
+	}
+	top := int(C.lua_gettop(L))
+	for i := 3; i <= top; i++ {
+		ltype := C.lua_type(L, C.int(i))
+		if ltype != C.LUA_TSTRING && ltype != C.LUA_TNUMBER {
+			panic(fmt.Sprintf("bad argument #%v to 'write' (string expected, got %v)", i-2, luaTypeName(ltype)))
+		}
+		if _, err := f.write([]byte(stringFromLua(L, C.int(i)))); err != nil {
+			return pushFileResult(L, err)
+		}
+	}
+	C.lua_pushvalue(L, 2)
+	return 1
+}
+
+func (f *File) linesIterator(closeAtEOF bool) func(State) int {
+	return func(state State) int {
+		L := state.L
+		f.checkOpen()
+		if f.reader == nil {
+			panic(errNotReadable.Error())
+		}
+		if err := f.Flush(); err != nil {
+			panic(err.Error())
+		}
+		line, ok := f.readLine()
+		if !ok {
+			if closeAtEOF {
+				f.close()
+			}
+			C.lua_pushnil(L)
+			return 1
+		}
+		pushStringToLua(L, line)
+		return 1
+	}
+}
+
+//
+// for line in f:lines() do ... end
+//
+func (f *File) luaLines(state State) int {
+	f.checkOpen()
+	state.pushObjToLua(f.linesIterator(false))
+	return 1
+}
+
+//
+// f:seek([whence [, offset]]), whence is "set", "cur" or "end"
+//
+func (f *File) luaSeek(state State) int {
+	L := state.L
+	f.checkOpen()
+	seeker, ok := f.handle.(io.Seeker)
+	if !ok {
+		return pushFileResult(L, fmt.Errorf("file is not seekable"))
+	}
+	whence := io.SeekCurrent
+	if C.lua_type(L, 3) == C.LUA_TSTRING {
+		switch stringFromLua(L, 3) {
+		case "set":
+			whence = io.SeekStart
+		case "cur":
+			whence = io.SeekCurrent
+		case "end":
+			whence = io.SeekEnd
+		default:
+			panic("bad argument #1 to 'seek' (invalid option)")
+		}
+	}
+	if err := f.Flush(); err != nil {
+		return pushFileResult(L, err)
+	}
+	offset := int64(C.lua_tointeger(L, 4))
+	if whence == io.SeekCurrent && f.reader != nil {
+		offset -= int64(f.reader.Buffered())
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err != nil {
+		return pushFileResult(L, err)
+	}
+	if f.reader != nil {
+		f.reader.Reset(f.handle.(io.Reader))
+	}
+	C.lua_pushinteger(L, C.lua_Integer(pos))
+	return 1
+}
+
+//
+// f:flush()
+//
+func (f *File) luaFlush(state State) int {
+	L := state.L
+	f.checkOpen()
+	if err := f.Flush(); err != nil {
+		return pushFileResult(L, err)
+	}
+	C.lua_pushvalue(L, 2)
+	return 1
+}
+
+//
+// f:setvbuf(mode [, size]), mode is "no", "full" or "line"
+//
+func (f *File) luaSetvbuf(state State) int {
+	L := state.L
+	f.checkOpen()
+	mode := stringFromLua(L, 3)
+	size := 4096
+	if C.lua_type(L, 4) == C.LUA_TNUMBER {
+		size = int(C.lua_tointeger(L, 4))
+	}
+	switch mode {
+	case "no", "full", "line":
+	default:
+		panic("bad argument #1 to 'setvbuf' (invalid option)")
+	}
+	if err := f.setvbuf(mode, size); err != nil {
+		return pushFileResult(L, err)
+	}
+	C.lua_pushboolean(L, 1)
+	return 1
+}
+
+func (f *File) setvbuf(mode string, size int) error {
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	f.wmode = mode
+	f.wbuf = nil
+	if mode != "no" && f.writer != nil {
+		f.wbuf = bufio.NewWriterSize(f.writer, size)
+	}
+	return nil
+}
+
+func (f *File) close() error {
+	err := f.Flush()
+	f.closed = true
+	if closer, ok := f.handle.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+//
+// io.type(obj) for files wrapped from go, nil for other values
+//
+func fileType(state State) int {
+	L := state.L
+	obj, _ := state.goObjectAt(2)
+	f, ok := obj.(*File)
+	if !ok {
+		C.lua_pushnil(L)
+	} else if f.closed {
+		pushStringToLua(L, "closed file")
+	} else {
+		pushStringToLua(L, "file")
+	}
+	return 1
+}
+
+const luaFileSetup = `
+local filetype = ...
+if io then
+	local io_type = io.type
+	io.type = function(obj)
+		return filetype(obj) or io_type(obj)
+	end
+end
+`
+
+func (vm *VM) initFileLib() {
+	vm.evalWithArgs(luaFileSetup, fileType)
+}
+
+func (f *File) luaClose(state State) int {
+	L := state.L
+	f.checkOpen()
+	if err := f.close(); err != nil {
+		return pushFileResult(L, err)
+	}
+	C.lua_pushboolean(L, 1)
+	return 1
+}
@@ -0,0 +1,108 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLua_streamfile(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	body := strings.NewReader("header\nline1\nline2\n")
+	var out bytes.Buffer
+	r.vm.AddFunc("stream.body", func() io.Reader { return body })
+	r.vm.AddFunc("stream.out", func() io.Writer { return &out })
+	r.vm.AddFunc("stream.rest", func(r io.Reader) string {
+		data, _ := io.ReadAll(r)
+		return string(data)
+	})
+
+	result = r.E(`
+		local f = stream.body()
+		local header = f:read("*l")
+		local same = rawequal(f, stream.body())
+		return header, same, io.type(f), io.type({}), stream.rest(stream.body())
+	`)
+	expect = []interface{}{"header", true, "file", nil, "line1\nline2\n"}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local f = stream.out()
+		f:setvbuf("full")
+		f:write("a", 1):write("\n")
+		return io.type(f)
+	`)
+	r.AssertEqual(result, []interface{}{"file"})
+	r.AssertEqual(out.String(), "")
+	r.E(`stream.out():flush()`)
+	r.AssertEqual(out.String(), "a1\n")
+
+	r.E(`
+		local f = stream.out()
+		f:setvbuf("line")
+		f:write("b")
+	`)
+	r.AssertEqual(out.String(), "a1\n")
+	r.E(`stream.out():write("\n")`)
+	r.AssertEqual(out.String(), "a1\nb\n")
+
+	result = r.E(`return stream.body():write("x")`)
+	r.AssertEqual(result, []interface{}{nil, "file is not writable"})
+	r.E_MustError(`stream.out():setvbuf("bad")`)
+}
+
+func TestLua_osfile(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	file, err := os.CreateTemp(t.TempDir(), "lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	r.vm.AddFunc("osfile.get", func() *os.File { return file })
+	r.vm.AddFunc("osfile.name", func(f *os.File) string { return f.Name() })
+
+	result := r.E(`
+		local f = osfile.get()
+		f:setvbuf("full")
+		f:write("x\ny\n")
+		f:seek("set")
+		local lines = {}
+		for line in f:lines() do
+			lines[#lines+1] = line
+		end
+		return #lines, lines[2], osfile.name(f) ~= nil
+	`)
+	r.AssertEqual(result, []interface{}{2.0, "y", true})
+
+	// go reads on from where lua stopped
+	r.vm.AddFunc("osfile.rest", func(f *os.File) string {
+		data, _ := io.ReadAll(f)
+		return string(data)
+	})
+	result = r.E(`
+		local f = osfile.get()
+		f:seek("set")
+		return f:read("*l"), osfile.rest(f)
+	`)
+	r.AssertEqual(result, []interface{}{"x", "y\n"})
+
+	lf := NewFile(strings.NewReader("go side"))
+	data, err := io.ReadAll(lf)
+	r.AssertEqual(string(data), "go side")
+	r.AssertEqual(lf.Close(), nil)
+	r.AssertEqual(lf.Close(), os.ErrClosed)
+}
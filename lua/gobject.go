@@ -84,3 +84,111 @@ func (state *State) luaTableToKeyValues(ltable int) (value reflect.Value, err er
 
 	return reflect.ValueOf(result), err
 }
+
+//
+// fill fields of the struct pointed by structPtr from a lua table,
+// keys are the field names used to index the struct from lua
+//
+func (state State) luaTableToStruct(ltable int, structPtr reflect.Value) error {
+	L := state.L
+	structValue := structPtr.Elem()
+	t := structValue.Type()
+	sinfo := state.VM.registerStruct(t)
+
+	if ltable < 0 {
+		ltable = int(C.lua_gettop(L)) + ltable + 1
+	}
+	C.lua_pushnil(L)
+	for {
+		if 0 == C.lua_next(L, C.int(ltable)) {
+			break
+		}
+
+		if C.lua_type(L, -2) != C.LUA_TSTRING {
+			C.lua_settop(L, -3) // pop 2
+			return fmt.Errorf("field key of struct must be a string")
+		}
+		key := stringFromLua(L, -2)
+		fld, ok := sinfo.fields[key]
+		if !ok || fld.typ != DATA_FIELD {
+			C.lua_settop(L, -3) // pop 2
+			return fmt.Errorf("not such field `%v' in `%v'", key, t)
+		}
+
+		sf := t.FieldByIndex(fld.dataIndex)
+		value, err := state.luaToGoValue(int(C.lua_gettop(L)), &sf.Type)
+		if err != nil {
+			C.lua_settop(L, -3) // pop 2
+			return fmt.Errorf("field `%v', %v", key, err)
+		}
+		if value.IsValid() {
+			structValue.FieldByIndex(fld.dataIndex).Set(value)
+		} else {
+			structValue.FieldByIndex(fld.dataIndex).Set(reflect.Zero(sf.Type))
+		}
+
+		C.lua_settop(L, -2) // pop 1
+	}
+	return nil
+}
+
+//
+// convert the array part of a lua table to a go slice
+//
+func (state State) luaTableToSlice(ltable int, typ reflect.Type) (reflect.Value, error) {
+	L := state.L
+	if ltable < 0 {
+		ltable = int(C.lua_gettop(L)) + ltable + 1
+	}
+	n := int(C.lua_objlen(L, C.int(ltable)))
+	tElem := typ.Elem()
+	slice := reflect.MakeSlice(typ, n, n)
+	for i := 0; i < n; i++ {
+		C.lua_rawgeti(L, C.int(ltable), C.int(i+1))
+		value, err := state.luaToGoValue(-1, &tElem)
+		C.lua_settop(L, -2) // pop 1
+		if err != nil {
+			return reflect.ValueOf(nil), fmt.Errorf("element #%v, %v", i+1, err)
+		}
+		if value.IsValid() {
+			slice.Index(i).Set(value)
+		}
+	}
+	return slice, nil
+}
+
+//
+// convert a lua table to a go map
+//
+func (state State) luaTableToMap(ltable int, typ reflect.Type) (reflect.Value, error) {
+	L := state.L
+	if ltable < 0 {
+		ltable = int(C.lua_gettop(L)) + ltable + 1
+	}
+	tKey := typ.Key()
+	tElem := typ.Elem()
+	m := reflect.MakeMap(typ)
+	C.lua_pushnil(L)
+	for {
+		if 0 == C.lua_next(L, C.int(ltable)) {
+			break
+		}
+		top := int(C.lua_gettop(L))
+		key, err := state.luaToGoValue(top-1, &tKey)
+		if err != nil {
+			C.lua_settop(L, -3) // pop 2
+			return reflect.ValueOf(nil), fmt.Errorf("map key, %v", err)
+		}
+		value, err := state.luaToGoValue(top, &tElem)
+		if err != nil {
+			C.lua_settop(L, -3) // pop 2
+			return reflect.ValueOf(nil), fmt.Errorf("map value, %v", err)
+		}
+		if !value.IsValid() {
+			value = reflect.Zero(tElem)
+		}
+		m.SetMapIndex(key, value)
+		C.lua_settop(L, -2) // pop 1
+	}
+	return m, nil
+}
@@ -16,8 +16,9 @@ import (
 	"fmt"
 	//"bytes"
 	//"unsafe"
-	//"strings"
 	"reflect"
+	"strings"
+	"time"
 )
 
 func mustBeMap(state State, lvalue int) *reflect.Value {
@@ -27,7 +28,7 @@ func mustBeMap(state State, lvalue int) *reflect.Value {
 	if ltype == C.LUA_TUSERDATA {
 		ref := C.clua_getGoRef(L, C.int(lvalue))
 		if ref != nil {
-			obj := (*refGo)(ref).obj
+			obj := readableOf((*refGo)(ref).obj)
 			objValue := reflect.ValueOf(obj)
 			if objValue.Kind() == reflect.Map {
 				vmap = &objValue
@@ -84,7 +85,501 @@ func luaHasKey(state State) int {
 	return 1
 }
 
+func luaNew(state State) int {
+	L := state.L
+	if C.lua_type(L, 2) != C.LUA_TSTRING {
+		C.lua_pushnil(L)
+		pushStringToLua(L, "New() needs a type name")
+		return 2
+	}
+	name := stringFromLua(L, 2)
+	typ, ok := state.VM.namedTypes[name]
+	if !ok {
+		C.lua_pushnil(L)
+		pushStringToLua(L, fmt.Sprintf("unknown type `%v'", name))
+		return 2
+	}
+	return state.newObject(typ, 3)
+}
+
+func (vm *VM) nameOfType(typ reflect.Type) string {
+	if name, ok := vm.typeNames[typ]; ok {
+		return name
+	}
+	if typ.Kind() == reflect.Ptr {
+		if name, ok := vm.typeNames[typ.Elem()]; ok {
+			return name
+		}
+	}
+	return typ.String()
+}
+
+func luaTypeOf(state State) int {
+	L := state.L
+	state.Checkany(2)
+	obj, ok := state.goObjectAt(2)
+	if !ok {
+		pushStringToLua(L, luaTypeName(C.lua_type(L, 2)))
+		return 1
+	}
+	if obj == nil {
+		pushStringToLua(L, "nil")
+		return 1
+	}
+	pushStringToLua(L, state.VM.nameOfType(reflect.TypeOf(obj)))
+	return 1
+}
+
+func luaIs(state State) int {
+	L := state.L
+	name := state.Checkstring(3)
+	typ, ok := state.VM.namedTypes[name]
+	if !ok {
+		C.lua_pushboolean(L, 0)
+		pushStringToLua(L, fmt.Sprintf("unknown type `%v'", name))
+		return 2
+	}
+	obj, ok := state.goObjectAt(2)
+	if ok && obj != nil {
+		objType := reflect.TypeOf(obj)
+		if objType == typ || objType == reflect.PtrTo(typ) {
+			C.lua_pushboolean(L, 1)
+			return 1
+		}
+	}
+	C.lua_pushboolean(L, 0)
+	return 1
+}
+
+//
+// golang.Set(obj, key, value) is the same as obj[key] = value, it is the
+// way to write back a struct read from a map, which is only a copy
+//
+func luaSet(state State) int {
+	L := state.L
+	obj, ok := state.goObjectAt(2)
+	if !ok || obj == nil {
+		C.lua_pushboolean(L, 0)
+		pushStringToLua(L, "Set() only apply to go object")
+		return 2
+	}
+	state.newindexObject(reflect.ValueOf(obj), 3, 4)
+	C.lua_pushboolean(L, 1)
+	return 1
+}
+
+var typeOfInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+
+var builtinTypes = map[string]reflect.Type{
+	"bool":        reflect.TypeOf(false),
+	"int":         reflect.TypeOf(int(0)),
+	"int8":        reflect.TypeOf(int8(0)),
+	"int16":       reflect.TypeOf(int16(0)),
+	"int32":       reflect.TypeOf(int32(0)),
+	"int64":       reflect.TypeOf(int64(0)),
+	"uint":        reflect.TypeOf(uint(0)),
+	"uint8":       reflect.TypeOf(uint8(0)),
+	"uint16":      reflect.TypeOf(uint16(0)),
+	"uint32":      reflect.TypeOf(uint32(0)),
+	"uint64":      reflect.TypeOf(uint64(0)),
+	"float32":     reflect.TypeOf(float32(0)),
+	"float64":     reflect.TypeOf(float64(0)),
+	"string":      reflect.TypeOf(""),
+	"byte":        reflect.TypeOf(byte(0)),
+	"rune":        reflect.TypeOf(rune(0)),
+	"interface{}": typeOfInterface,
+	"any":         typeOfInterface,
+}
+
+//
+// parse a go type name, e.g. `[]int', `map[string]*Point', where the
+// struct names are the names given to AddType
+//
+func (vm *VM) typeByName(name string) (reflect.Type, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case strings.HasPrefix(name, "[]"):
+		elem, err := vm.typeByName(name[2:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	case strings.HasPrefix(name, "*"):
+		elem, err := vm.typeByName(name[1:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.PtrTo(elem), nil
+	case strings.HasPrefix(name, "map["):
+		depth := 0
+		for i := 3; i < len(name); i++ {
+			switch name[i] {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			}
+			if depth == 0 {
+				key, err := vm.typeByName(name[4:i])
+				if err != nil {
+					return nil, err
+				}
+				elem, err := vm.typeByName(name[i+1:])
+				if err != nil {
+					return nil, err
+				}
+				return reflect.MapOf(key, elem), nil
+			}
+		}
+		return nil, fmt.Errorf("bad map type `%v'", name)
+	}
+	if typ, ok := builtinTypes[name]; ok {
+		return typ, nil
+	}
+	if typ, ok := vm.namedTypes[name]; ok {
+		return typ, nil
+	}
+	return nil, fmt.Errorf("unknown type `%v'", name)
+}
+
+//
+// get the slice of a go object, a slice held by pointer can grow
+//
+func sliceOf(obj interface{}) (slice reflect.Value, ptr reflect.Value, ok bool) {
+	v := reflect.ValueOf(obj)
+	switch {
+	case v.Kind() == reflect.Slice:
+		return v, reflect.Value{}, true
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Slice && !v.IsNil():
+		return v.Elem(), v, true
+	}
+	return reflect.Value{}, reflect.Value{}, false
+}
+
+func pushNilAndError(L *C.lua_State, format string, a ...interface{}) int {
+	C.lua_pushnil(L)
+	pushStringToLua(L, fmt.Sprintf(format, a...))
+	return 2
+}
+
+func luaAppend(state State) int {
+	L := state.L
+	obj, _ := state.goObjectAt(2)
+	slice, ptr, ok := sliceOf(obj)
+	if !ok {
+		return pushNilAndError(L, "Append() only apply to `slice'")
+	}
+	tElem := slice.Type().Elem()
+	top := int(C.lua_gettop(L))
+	for i := 3; i <= top; i++ {
+		value, err := state.luaToGoValue(i, &tElem)
+		if err != nil {
+			return pushNilAndError(L, "arg #%v, %v", i-1, err)
+		}
+		if !value.IsValid() {
+			value = reflect.Zero(tElem)
+		}
+		slice = reflect.Append(slice, value)
+	}
+	if ptr.IsValid() {
+		ptr.Elem().Set(slice)
+		C.lua_pushvalue(L, 2)
+		return 1
+	}
+	state.pushObjToLua(slice.Interface())
+	return 1
+}
+
+func luaDelete(state State) int {
+	L := state.L
+	obj, _ := state.goObjectAt(2)
+	if view, ok := obj.(*readOnlyView); ok {
+		C.lua_pushboolean(L, 0)
+		pushStringToLua(L, "Delete() can not modify a "+view.String())
+		return 2
+	}
+	if vmap := mustBeMap(state, 2); vmap != nil {
+		keyType := vmap.Type().Key()
+		key, err := state.luaToGoValue(3, &keyType)
+		if err != nil {
+			C.lua_pushboolean(L, 0)
+			pushStringToLua(L, err.Error())
+			return 2
+		}
+		vmap.SetMapIndex(key, reflect.Value{})
+		C.lua_pushboolean(L, 1)
+		return 1
+	}
+	slice, ptr, ok := sliceOf(obj)
+	if !ok || !ptr.IsValid() {
+		C.lua_pushboolean(L, 0)
+		pushStringToLua(L, "Delete() only apply to `map' or pointer to `slice'")
+		return 2
+	}
+	idx := int(C.lua_tointeger(L, 3)) - state.VM.indexBaseOf(slice.Type())
+	if idx < 0 || idx >= slice.Len() {
+		C.lua_pushboolean(L, 0)
+		pushStringToLua(L, "index out of range")
+		return 2
+	}
+	ptr.Elem().Set(reflect.AppendSlice(slice.Slice(0, idx), slice.Slice(idx+1, slice.Len())))
+	C.lua_pushboolean(L, 1)
+	return 1
+}
+
+//
+// golang.MakeSlice(typeName, len [, cap]) returns a pointer to the new
+// slice, so that it can grow from lua
+//
+func luaMakeSlice(state State) int {
+	L := state.L
+	typ, err := state.VM.typeByName(stringFromLua(L, 2))
+	if err != nil {
+		return pushNilAndError(L, "%v", err)
+	}
+	n := int(C.lua_tointeger(L, 3))
+	capacity := int(C.lua_tointeger(L, 4))
+	if n < 0 || capacity < 0 {
+		return pushNilAndError(L, "negative slice size")
+	}
+	if capacity < n {
+		capacity = n
+	}
+	ptr := reflect.New(reflect.SliceOf(typ))
+	ptr.Elem().Set(reflect.MakeSlice(reflect.SliceOf(typ), n, capacity))
+	state.goToLuaValue(ptr)
+	return 1
+}
+
+func luaMakeMap(state State) int {
+	L := state.L
+	keyType, err := state.VM.typeByName(stringFromLua(L, 2))
+	if err != nil {
+		return pushNilAndError(L, "%v", err)
+	}
+	valueType, err := state.VM.typeByName(stringFromLua(L, 3))
+	if err != nil {
+		return pushNilAndError(L, "%v", err)
+	}
+	if !keyType.Comparable() {
+		return pushNilAndError(L, "invalid map key type `%v'", keyType)
+	}
+	state.goToLuaValue(reflect.MakeMap(reflect.MapOf(keyType, valueType)))
+	return 1
+}
+
+func luaCopy(state State) int {
+	L := state.L
+	dstObj, _ := state.goObjectAt(2)
+	srcObj, _ := state.goObjectAt(3)
+	dst, _, ok1 := sliceOf(dstObj)
+	src, _, ok2 := sliceOf(readableOf(srcObj))
+	if !ok1 || !ok2 {
+		return pushNilAndError(L, "Copy() only apply to `slice'")
+	}
+	if dst.Type().Elem() != src.Type().Elem() {
+		return pushNilAndError(L, "Copy() from `%v' to `%v'", src.Type(), dst.Type())
+	}
+	n := reflect.Copy(dst, src)
+	C.lua_pushinteger(L, C.lua_Integer(n))
+	return 1
+}
+
+//
+// golang.Sub(slice, i [, j]) is slice[i:j] if the index base is 0, and
+// is elements from i to j inclusive like string.sub if the base is 1
+//
+func luaSub(state State) int {
+	L := state.L
+	obj, _ := state.goObjectAt(2)
+	slice, _, ok := sliceOf(readableOf(obj))
+	if !ok {
+		return pushNilAndError(L, "Sub() only apply to `slice'")
+	}
+	base := state.VM.indexBaseOf(slice.Type())
+	from := base
+	if C.lua_type(L, 3) == C.LUA_TNUMBER {
+		from = int(C.lua_tointeger(L, 3))
+	}
+	to := slice.Len()
+	if C.lua_type(L, 4) == C.LUA_TNUMBER {
+		to = int(C.lua_tointeger(L, 4))
+	}
+	from -= base
+	if from < 0 || to < from || to > slice.Len() {
+		return pushNilAndError(L, "slice bounds out of range")
+	}
+	if _, ok := obj.(*readOnlyView); ok {
+		state.pushReadOnly(slice.Slice(from, to))
+		return 1
+	}
+	state.pushObjToLua(slice.Slice(from, to).Interface())
+	return 1
+}
+
+func luaLen(state State) int {
+	L := state.L
+	var n int
+	switch C.lua_type(L, 2) {
+	case C.LUA_TSTRING, C.LUA_TTABLE:
+		n = int(C.lua_objlen(L, 2))
+	default:
+		obj, _ := state.goObjectAt(2)
+		obj = readableOf(obj)
+		v := reflect.ValueOf(obj)
+		if slice, _, ok := sliceOf(obj); ok {
+			v = slice
+		}
+		switch v.Kind() {
+		case reflect.Slice, reflect.Map, reflect.String, reflect.Array, reflect.Chan:
+			n = v.Len()
+		default:
+			return pushNilAndError(L, "Len() can not apply to `%v'", luaTypeName(C.lua_type(L, 2)))
+		}
+	}
+	C.lua_pushinteger(L, C.lua_Integer(n))
+	return 1
+}
+
+//
+// shallow copy of a go slice or map to a lua table, the maps and slices
+// in the table are read-only views when the source is one
+//
+func luaToTable(state State) int {
+	L := state.L
+	obj, _ := state.goObjectAt(2)
+	_, readOnly := obj.(*readOnlyView)
+	pushElem := func(value reflect.Value) {
+		if readOnly {
+			state.pushReadOnly(value)
+		} else {
+			state.goToLuaValue(value)
+		}
+	}
+	if slice, _, ok := sliceOf(readableOf(obj)); ok {
+		n := slice.Len()
+		C.lua_createtable(L, C.int(n), 0)
+		for i := 0; i < n; i++ {
+			pushElem(slice.Index(i))
+			C.lua_rawseti(L, -2, C.int(i+1))
+		}
+		return 1
+	}
+	if vmap := mustBeMap(state, 2); vmap != nil {
+		C.lua_createtable(L, 0, C.int(vmap.Len()))
+		iter := vmap.MapRange()
+		for iter.Next() {
+			if !state.goToLuaValue(iter.Key()) {
+				C.lua_settop(L, -2) // pop 1
+				continue
+			}
+			pushElem(iter.Value())
+			C.lua_rawset(L, -3)
+		}
+		return 1
+	}
+	return pushNilAndError(L, "ToTable() only apply to `slice' or `map'")
+}
+
+//
+// golang.FromTable(typeName, table) converts a lua table to a go value,
+// slices are returned by pointer like golang.MakeSlice
+//
+func luaFromTable(state State) int {
+	L := state.L
+	typ, err := state.VM.typeByName(stringFromLua(L, 2))
+	if err != nil {
+		return pushNilAndError(L, "%v", err)
+	}
+	if C.lua_type(L, 3) != C.LUA_TTABLE {
+		return pushNilAndError(L, "FromTable() needs a table")
+	}
+	value, err := state.luaToGoValue(3, &typ)
+	if err != nil {
+		return pushNilAndError(L, "%v", err)
+	}
+	if typ.Kind() == reflect.Slice {
+		ptr := reflect.New(typ)
+		ptr.Elem().Set(value)
+		value = ptr
+	}
+	state.goToLuaValue(value)
+	return 1
+}
+
+//
+// make a function that boxes its argument as a go value of type typ,
+// so that it keeps its exact type when passed as `interface{}'
+//
+func luaBoxer(typ reflect.Type) func(State) int {
+	return func(state State) int {
+		L := state.L
+		value, err := state.luaToGoValue(2, &typ)
+		if err != nil {
+			return pushNilAndError(L, "%v", err)
+		}
+		state.pushObjToLua(value.Interface())
+		return 1
+	}
+}
+
+func luaBytes(state State) int {
+	L := state.L
+	if C.lua_type(L, 2) != C.LUA_TSTRING {
+		return pushNilAndError(L, "Bytes() needs a string")
+	}
+	state.pushObjToLua([]byte(stringFromLua(L, 2)))
+	return 1
+}
+
+//
+// golang.Time(unixSeconds) or golang.Time("2006-01-02T15:04:05Z")
+//
+func luaTime(state State) int {
+	L := state.L
+	value, err := state.luaToGoValue(2, &typeOfTime)
+	if err != nil {
+		return pushNilAndError(L, "%v", err)
+	}
+	state.goToLuaValue(value)
+	return 1
+}
+
+func luaNow(state State) int {
+	state.goToLuaValue(reflect.ValueOf(time.Now()))
+	return 1
+}
+
 func lua_initGolangLib(vm *VM) {
 	vm.AddFunc("golang.Keys", luaKeys)
 	vm.AddFunc("golang.HasKey", luaHasKey)
+	vm.AddFunc("golang.New", luaNew)
+	vm.AddFunc("golang.TypeOf", luaTypeOf)
+	vm.AddFunc("golang.Is", luaIs)
+	vm.AddFunc("golang.Set", luaSet)
+	vm.AddFunc("golang.Append", luaAppend)
+	vm.AddFunc("golang.Delete", luaDelete)
+	vm.AddFunc("golang.MakeSlice", luaMakeSlice)
+	vm.AddFunc("golang.MakeMap", luaMakeMap)
+	vm.AddFunc("golang.Copy", luaCopy)
+	vm.AddFunc("golang.Sub", luaSub)
+	vm.AddFunc("golang.Len", luaLen)
+	vm.AddFunc("golang.ToTable", luaToTable)
+	vm.AddFunc("golang.FromTable", luaFromTable)
+	vm.AddFunc("golang.ReadOnly", luaReadOnly)
+	vm.AddFunc("golang.Extend", luaExtend)
+	vm.AddFunc("golang.Props", luaProps)
+
+	for _, name := range []string{
+		"Int", "Int8", "Int16", "Int32", "Int64",
+		"Uint", "Uint8", "Uint16", "Uint32", "Uint64",
+		"Float32", "Float64",
+	} {
+		typ := builtinTypes[strings.ToLower(name)]
+		vm.AddFunc("golang."+name, luaBoxer(typ))
+	}
+	vm.AddFunc("golang.Bytes", luaBytes)
+	vm.AddFunc("golang.Duration", luaBoxer(typeOfDuration))
+	vm.AddFunc("golang.Time", luaTime)
+	vm.AddFunc("golang.Now", luaNow)
 }
@@ -0,0 +1,223 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLua_newtype(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	r.vm.AddType("Point", reflect.TypeOf(Point{}))
+	r.vm.AddType("geo.Rect", reflect.TypeOf(&Rect{}))
+	r.vm.AddFunc("SumPoint", func(p *Point) int { return p.X + p.Y })
+
+	result = r.E(`
+		local p1 = golang.New("Point", {X=1, Y=2})
+		local p2 = Point{X=3}
+		local p3 = Point()
+		return p1.X, p1.Y, p2.X, p2.Y, p3:SumXY()
+	`)
+	expect = []interface{}{1.0, 2.0, 3.0, 0.0, 0.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local rect = geo.Rect{Width=10, Height=20}
+		return golang.TypeOf(rect), golang.Is(rect, "geo.Rect"),
+			golang.Is(rect, "Point"), golang.TypeOf({}), golang.TypeOf(golang.Keys)
+	`)
+	expect = []interface{}{"geo.Rect", true, false, "table", "func(lua.State) int"}
+	r.AssertEqual(result, expect)
+
+	for code, msg := range map[string]string{
+		`golang.TypeOf()`:            "bad argument #1 (value expected)",
+		`golang.Is(geo.Rect{}, nil)`: "bad argument #2 (string expected, got nil)",
+	} {
+		_, err := r.vm.EvalStringWithError(code)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%v: unexpected error %v", code, err)
+		}
+	}
+
+	// tables convert to struct args
+	result = r.E(`
+		return SumPoint({X=4, Y=5})
+	`)
+	expect = []interface{}{9.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local p, err = Point{Z=1}
+		local q, err2 = golang.New("NoSuchType")
+		return p, err ~= nil, q, err2
+	`)
+	expect = []interface{}{nil, true, nil, "unknown type `NoSuchType'"}
+	r.AssertEqual(result, expect)
+
+	r.E_MustError(`
+		return SumPoint({X='abc'})
+	`)
+}
+
+func TestLua_elemref(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	points := []Point{{1, 2}, {3, 4}}
+	pointMap := map[string]Point{"a": {5, 6}}
+	r.vm.AddFunc("GetPoints", func() []Point { return points })
+	r.vm.AddFunc("GetPointMap", func() map[string]Point { return pointMap })
+
+	// elements of a slice of structs are references
+	result = r.E(`
+		local pts = GetPoints()
+		pts[0].X = 10
+		local p = pts[1]
+		p.Y = 40
+		return pts[0].X, pts[1].Y, pts[1] == p
+	`)
+	expect = []interface{}{10.0, 40.0, true}
+	r.AssertEqual(result, expect)
+	r.AssertEqual(points, []Point{{10, 2}, {3, 40}})
+
+	// values of a map are copies, golang.Set writes them back
+	result = r.E(`
+		local m = GetPointMap()
+		local p = m.a
+		p.X = 50
+		local before = m.a.X
+		golang.Set(m, "a", p)
+		return before, m.a.X
+	`)
+	expect = []interface{}{5.0, 50.0}
+	r.AssertEqual(result, expect)
+	r.AssertEqual(pointMap["a"], Point{50, 6})
+
+	result = r.E(`
+		return golang.Set({}, 1, 2)
+	`)
+	expect = []interface{}{false, "Set() only apply to go object"}
+	r.AssertEqual(result, expect)
+}
+
+func TestLua_collections(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	r.vm.AddType("Point", reflect.TypeOf(Point{}))
+	r.vm.AddFunc("Sum", func(values []int) int {
+		sum := 0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	})
+
+	result = r.E(`
+		local s = golang.MakeSlice("int", 2)
+		s[0], s[1] = 1, 2
+		golang.Append(s, 3, 4)
+		local sub = golang.Sub(s, 1, 3)
+		return golang.Len(s), Sum(s), Sum(sub), golang.Len(sub)
+	`)
+	expect = []interface{}{4.0, 10.0, 5.0, 2.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local s = golang.FromTable("[]int", {5, 6, 7})
+		golang.Delete(s, 1)
+		local dst = golang.MakeSlice("int", 5)
+		local n = golang.Copy(dst, s)
+		local t = golang.ToTable(dst)
+		return n, #t, t[1], t[2], t[3]
+	`)
+	expect = []interface{}{2.0, 5.0, 5.0, 7.0, 0.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local m = golang.MakeMap("string", "[]*Point")
+		m.a = { Point{X=1}, Point{X=2} }
+		local t = golang.ToTable(m)
+		local n = golang.Len(m)
+		golang.Delete(m, "a")
+		return n, golang.Len(t.a), t.a[1].X, golang.HasKey(m, "a")
+	`)
+	expect = []interface{}{1.0, 2.0, 2.0, false}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local m = golang.FromTable("map[string]int", {a=1, b=2})
+		return m.a + m.b, golang.Len("abc"), golang.Len({1, 2})
+	`)
+	expect = []interface{}{3.0, 3.0, 2.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local s, err = golang.MakeSlice("NoSuchType", 1)
+		local a, err2 = golang.Append({}, 1)
+		return s, err, a, err2
+	`)
+	expect = []interface{}{nil, "unknown type `NoSuchType'", nil, "Append() only apply to `slice'"}
+	r.AssertEqual(result, expect)
+}
+
+func TestLua_typehint(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	values := map[string]interface{}{}
+	r.vm.AddFunc("Types", func(args ...interface{}) []interface{} {
+		return args
+	})
+	r.vm.AddFunc("GetValues", func() map[string]interface{} { return values })
+	r.vm.AddFunc("Add64", func(a, b int64) int64 { return a + b })
+
+	result = r.E(`
+		return Types(golang.Int(1), golang.Int32(2), golang.Uint64(3),
+			golang.Float32(1.5), golang.Bytes("ab"), golang.Duration("5s"),
+			golang.Duration(0.5), 4)
+	`)
+	expect = []interface{}{[]interface{}{
+		int(1), int32(2), uint64(3), float32(1.5), []byte("ab"),
+		5 * time.Second, 500 * time.Millisecond, 4.0,
+	}}
+	r.AssertEqual(result, expect)
+
+	r.E(`
+		local m = GetValues()
+		m.i = golang.Int8(-1)
+		m.u = golang.Uint16(7)
+	`)
+	r.AssertEqual(values, map[string]interface{}{"i": int8(-1), "u": uint16(7)})
+
+	// boxed numbers convert to other number types
+	result = r.E(`
+		return Add64(golang.Int32(1), golang.Uint8(2))
+	`)
+	expect = []interface{}{3.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		return golang.Duration("bad")
+	`)
+	r.AssertEqual(result[0], nil)
+}
@@ -0,0 +1,118 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+
+static int clua_getinfoS(lua_State *L, lua_Debug *ar) {
+	return lua_getinfo(L, "S", ar);
+}
+
+static int clua_getinfof(lua_State *L, lua_Debug *ar) {
+	return lua_getinfo(L, "f", ar);
+}
+*/
+import "C"
+import (
+	"sync"
+	"unsafe"
+)
+
+//
+// lua hooks only know the lua_State, the VM of a hook is found by the id
+// stored in the registry of the state
+//
+var hookVMs = struct {
+	sync.Mutex
+	next int
+	vms  map[int]*VM
+}{vms: make(map[int]*VM)}
+
+func hookVM(id int) *VM {
+	hookVMs.Lock()
+	defer hookVMs.Unlock()
+	return hookVMs.vms[id]
+}
+
+//
+// install the lua hook for the tools in use, e.g. the profiler.
+// Coroutines get the hook of the thread creating them, so coroutines
+// created before a tool is started are not seen by it.
+//
+func (vm *VM) updateHook() {
+	mask, count := 0, 0
+	if vm.profiler != nil {
+		mask |= C.LUA_MASKCOUNT
+		count = vm.profiler.period
+	}
+	if vm.cover != nil {
+		mask |= C.LUA_MASKCALL | C.LUA_MASKLINE
+	}
+	if vm.debugger != nil {
+		mask |= C.LUA_MASKLINE
+	}
+
+	hookVMs.Lock()
+	if mask != 0 && vm.hookID == 0 {
+		hookVMs.next++
+		vm.hookID = hookVMs.next
+		hookVMs.vms[vm.hookID] = vm
+	}
+	if mask == 0 && vm.hookID != 0 {
+		delete(hookVMs.vms, vm.hookID)
+		vm.hookID = 0
+	}
+	hookVMs.Unlock()
+
+	if vm.globalL != nil {
+		C.clua_setHook(vm.globalL, C.int(vm.hookID), C.int(mask), C.int(count))
+	}
+}
+
+//export GO_luaHook
+func GO_luaHook(_L unsafe.Pointer, id int, _ar unsafe.Pointer) {
+	vm := hookVM(id)
+	if vm == nil {
+		return
+	}
+	// a panic must not unwind through the C hook
+	defer func() {
+		if r := recover(); r != nil {
+			vm.logPanic("lua hook", r)
+		}
+	}()
+	L := (*C.lua_State)(_L)
+	ar := (*C.lua_Debug)(_ar)
+	state := State{vm, L}
+	switch ar.event {
+	case C.LUA_HOOKCOUNT:
+		if vm.profiler != nil {
+			vm.profiler.sample(state, "")
+		}
+	case C.LUA_HOOKCALL:
+		if vm.cover != nil {
+			C.clua_getinfoS(L, ar)
+			if name, ok := chunkName(ar.source); ok && C.GoString(ar.what) != "C" && !vm.cover.seen[coverKey{name, int(ar.linedefined)}] {
+				C.clua_getinfof(L, ar)
+				C.clua_coverFunction(L, C.int(id))
+			}
+		}
+	case C.LUA_HOOKLINE:
+		if vm.cover != nil {
+			line := int(ar.currentline)
+			C.clua_getinfoS(L, ar)
+			if name, ok := chunkName(ar.source); ok {
+				vm.cover.cov.hit(name, line)
+			}
+		}
+		if vm.debugger != nil {
+			vm.debugger.line(state, ar)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	//"strings"
 	//"errors"
 	"runtime"
+	"sync"
 )
 
 type ILuaRef interface {
@@ -40,16 +41,65 @@ type Function struct {
 	RefLua
 }
 
+//
+// releaseQueue collects registry references dropped by the garbage
+// collector. Finalizers run on their own goroutine and must not touch
+// the lua state, so they only queue the reference here, and the VM
+// unrefs it later on its own goroutine.
+//
+type releaseQueue struct {
+	mu     sync.Mutex
+	closed bool
+	refs   []int
+}
+
+func (q *releaseQueue) push(ref int) {
+	q.mu.Lock()
+	if !q.closed {
+		q.refs = append(q.refs, ref)
+	}
+	q.mu.Unlock()
+}
+
+func (q *releaseQueue) take() []int {
+	q.mu.Lock()
+	refs := q.refs
+	q.refs = nil
+	q.mu.Unlock()
+	return refs
+}
+
+func (q *releaseQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.refs = nil
+	q.mu.Unlock()
+}
+
 func (self *RefLua) init(state State, lobject int) {
-	self.VM = state.VM
+	vm := state.VM
+	self.VM = vm
 	C.lua_pushvalue(state.L, C.int(lobject))
 	refvalue := C.luaL_ref(state.L, C.LUA_REGISTRYINDEX)
 	self.Ref = int(refvalue)
+	vm.luaRefs[self.Ref] = true
+	if vm.leakTracking {
+		vm.luaRefStacks[self.Ref] = vm.traceStack()
+	}
 	runtime.SetFinalizer(self, func(r *RefLua) {
-		r.Release()
+		if r.Ref != 0 {
+			vm.releases.push(r.Ref)
+		}
 	})
 }
 
+//
+// a reference is valid until it is released or its VM is closed
+//
+func (self *RefLua) valid() bool {
+	return self.Ref != 0 && self.VM != nil && self.VM.globalL != nil
+}
+
 func (state State) NewLuaRef(lobject int) *RefLua {
 	r := new(RefLua)
 	r.init(state, lobject)
@@ -68,8 +118,10 @@ func (state State) NewLuaFunction(lobject int) *Function {
 	return f
 }
 
+func (self *RefLua) ILuaRef() {}
+
 func (self *RefLua) PushValue(state State) {
-	if self.Ref != 0 && self.VM.globalL != nil {
+	if self.valid() {
 		C.lua_rawgeti(state.L, C.LUA_REGISTRYINDEX, C.int(self.Ref))
 	}
 }
@@ -78,8 +130,8 @@ func (self *RefLua) PushValue(state State) {
 // release reference to lua object
 //
 func (self *RefLua) Release() {
-	if self.Ref != 0 && self.VM.globalL != nil {
-		C.luaL_unref(self.VM.globalL, C.LUA_REGISTRYINDEX, C.int(self.Ref))
+	if self.valid() {
+		self.VM.unref(self.Ref)
 	}
 	self.VM = nil
 	self.Ref = 0
@@ -97,7 +149,7 @@ func callLuaFunc(state State, in []interface{}, nout int) ([]interface{}, error)
 // call a lua function
 //
 func (fn *Function) Call(in ...interface{}) ([]interface{}, error) {
-	if fn.Ref == 0 {
+	if !fn.valid() {
 		return make([]interface{}, 0), fmt.Errorf("cannot call a released lua function")
 	}
 	L := fn.VM.globalL
@@ -107,7 +159,7 @@ func (fn *Function) Call(in ...interface{}) ([]interface{}, error) {
 }
 
 func (fn *Function) VCallWith(in []reflect.Value, nout int) ([]interface{}, error) {
-	if fn.Ref == 0 {
+	if !fn.valid() {
 		return make([]interface{}, 0), fmt.Errorf("cannot call a released lua function")
 	}
 	L := fn.VM.globalL
@@ -117,7 +169,7 @@ func (fn *Function) VCallWith(in []reflect.Value, nout int) ([]interface{}, erro
 }
 
 func (fn *Function) CallWith(in []interface{}, nout int) ([]interface{}, error) {
-	if fn.Ref == 0 {
+	if !fn.valid() {
 		return make([]interface{}, 0), fmt.Errorf("cannot call a released lua function")
 	}
 	L := fn.VM.globalL
@@ -126,12 +178,66 @@ func (fn *Function) CallWith(in []interface{}, nout int) ([]interface{}, error)
 	return callLuaFunc(state, in, nout)
 }
 
+//
+// call a lua function, and store its results to the pointers outs. The
+// results are converted to the types pointed to like the arguments of go
+// functions, e.g. tables to structs, slices and maps. Missing results
+// are zero values.
+//
+func (fn *Function) CallInto(in []interface{}, outs ...interface{}) error {
+	if !fn.valid() {
+		return fmt.Errorf("cannot call a released lua function")
+	}
+	outTypes := make([]reflect.Type, len(outs))
+	for i, out := range outs {
+		v := reflect.ValueOf(out)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return fmt.Errorf("CallInto needs non-nil pointers, got `%v' as out #%v", reflect.TypeOf(out), i+1)
+		}
+		outTypes[i] = v.Type().Elem()
+	}
+	inv := make([]reflect.Value, 0, len(in))
+	for _, x := range in {
+		inv = append(inv, reflect.ValueOf(x))
+	}
+	L := fn.VM.globalL
+	state := State{fn.VM, L}
+	fn.PushValue(state)
+	values, err := callLuaFuncValues(state, inv, 0, outTypes)
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		reflect.ValueOf(outs[i]).Elem().Set(value)
+	}
+	return nil
+}
+
+//
+// call a lua function, and return its first result as a T, see CallInto
+//
+func Call1[T any](fn *Function, in ...interface{}) (T, error) {
+	var r T
+	err := fn.CallInto(in, &r)
+	return r, err
+}
+
+//
+// call a lua function, and return its first two results, see CallInto
+//
+func Call2[T1, T2 any](fn *Function, in ...interface{}) (T1, T2, error) {
+	var r1 T1
+	var r2 T2
+	err := fn.CallInto(in, &r1, &r2)
+	return r1, r2, err
+}
+
 func (fn *Function) String() string {
 	return fmt.Sprintf("<lua fuction @%v>", fn.Ref)
 }
 
 func (tbl *Table) Set(key interface{}, value interface{}) (bool, error) {
-	if tbl.Ref == 0 {
+	if !tbl.valid() {
 		return false, fmt.Errorf("cannot set a released lua table")
 	}
 	L := tbl.VM.globalL
@@ -142,18 +248,23 @@ func (tbl *Table) Set(key interface{}, value interface{}) (bool, error) {
 	tbl.PushValue(state)
 
 	vkey := reflect.ValueOf(key)
-	ok := state.goToLuaValue(vkey)
+	ok, err := state.pushGoValue(vkey)
+	if err != nil {
+		return false, err
+	}
 	if !ok {
 		return false, fmt.Errorf("invalid key type for lua type: %v", vkey.Kind())
 	}
-	state.goToLuaValue(reflect.ValueOf(value))
+	if _, err := state.pushGoValue(reflect.ValueOf(value)); err != nil {
+		return false, err
+	}
 	C.lua_settable(L, C.int(-3))
 
 	return true, nil
 }
 
 func (tbl *Table) GetWithError(key interface{}) (interface{}, error) {
-	if tbl.Ref == 0 {
+	if !tbl.valid() {
 		return nil, fmt.Errorf("cannot get a released lua table")
 	}
 	L := tbl.VM.globalL
@@ -164,7 +275,10 @@ func (tbl *Table) GetWithError(key interface{}) (interface{}, error) {
 	tbl.PushValue(state)
 
 	vkey := reflect.ValueOf(key)
-	ok := state.goToLuaValue(vkey)
+	ok, err := state.pushGoValue(vkey)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
 		return nil, fmt.Errorf("invalid key type for lua type: %v", vkey.Kind())
 	}
@@ -186,7 +300,7 @@ func (tbl *Table) Get(key interface{}) interface{} {
 }
 
 func (tbl *Table) GetnWithError() (int, error) {
-	if tbl.Ref == 0 {
+	if !tbl.valid() {
 		return 0, fmt.Errorf("cannot get lenght a released lua table")
 	}
 	L := tbl.VM.globalL
@@ -206,7 +320,7 @@ func (tbl *Table) Getn() int {
 }
 
 func (tbl *Table) Foreach(fn func(key interface{}, value interface{}) bool) {
-	if tbl.Ref == 0 {
+	if !tbl.valid() {
 		return
 	}
 
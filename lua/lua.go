@@ -9,6 +9,7 @@ package lua
 #cgo linux CFLAGS: -DLUA_USE_LINUX
 #cgo linux LDFLAGS: -ldl
 #cgo LDFLAGS: -lm
+#include <stdlib.h>
 #include <lua.h>
 #include <lauxlib.h>
 #include <lualib.h>
@@ -20,8 +21,10 @@ import (
 	"fmt"
 	"goinfi/base"
 	"io"
+	"log/slog"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -39,6 +42,19 @@ type refGo struct {
 	next *refGo
 	vm   *VM
 	obj  interface{}
+	key  objKey
+	name string // name of a function added by AddFunc
+
+	stack []uintptr // allocation stack when leak tracking is on
+}
+
+//
+// identity of a go pointer or map, the type is part of the key because
+// a struct and its first field share the same address
+//
+type objKey struct {
+	typ reflect.Type
+	ptr uintptr
 }
 
 func (self *refGo) link(head *refGo) {
@@ -59,6 +75,42 @@ func (self *refGo) unlink() {
 	self.next = nil
 }
 
+//
+// the pointer to the node kept in a lua userdata. The node is linked in
+// the VM until lua collects the userdata, so it stays reachable for the
+// go collector, which does not move it, as long as lua holds the pointer.
+// This is the only place where the nodes are given to C.
+//
+func (self *refGo) cptr() unsafe.Pointer {
+	return unsafe.Pointer(self)
+}
+
+//
+// implemented by the types of this package which have methods in lua,
+// the map is from lua name to a method expression, e.g. (*Buffer).Sub.
+// Raw methods `func(*T, State) int' or `func(*T, State) (int, error)' get
+// the receiver at 2.
+//
+type luaMethoder interface {
+	luaMethods() map[string]interface{}
+}
+
+//
+// implemented by go objects which release resources when their
+// userdata is collected by lua
+//
+type luaFinalizer interface {
+	luaFinalize()
+}
+
+//
+// implemented by the types of this package which support the lua
+// length operator
+//
+type luaLengther interface {
+	luaLen() int
+}
+
 type structFieldType uint
 
 const (
@@ -73,6 +125,7 @@ type structField struct {
 	typ         structFieldType
 	dataIndex   []int
 	methodIndex int
+	method      reflect.Value // set for the methods given by luaMethods
 }
 
 type structInfo struct {
@@ -81,6 +134,8 @@ type structInfo struct {
 
 	cache map[*C.char]*structField
 	lref  map[string]int
+
+	policy *typePolicy
 }
 
 func (sinfo *structInfo) makeFieldsIndexCache(vm *VM) {
@@ -105,6 +160,44 @@ type VM struct {
 	globalL   *C.lua_State
 	refLink   refGo
 	structTbl map[reflect.Type]*structInfo
+
+	luaRefs  map[int]bool // registry references held by RefLua
+	releases releaseQueue
+	objCache map[objKey]*refGo
+
+	leakTracking bool
+	luaRefStacks map[int][]uintptr
+
+	namedTypes map[string]reflect.Type
+	typeNames  map[reflect.Type]string
+
+	indexBase     int
+	typeIndexBase map[reflect.Type]int
+
+	durationNanoseconds bool
+
+	converters map[reflect.Type]*converter
+	extends    map[reflect.Type]C.int // registry references of golang.Extend tables
+
+	stdout io.Writer
+	stderr io.Writer
+	logger *slog.Logger
+
+	files map[interface{}]*File // go streams wrapped for lua
+
+	hookID      int
+	profiler    *profiler
+	profileRate int
+	cover       *coverState
+	debugger    *debugger
+
+	snapshotDepth int
+	snapshotRef   C.int
+	snapshot      *LuaError // taken by the failed call
+
+	beforeCall func(info *CallInfo) error
+	afterCall  func(info *CallInfo)
+	metrics    atomic.Pointer[callMetrics] // read by Metrics from any goroutine
 }
 
 type State struct {
@@ -117,6 +210,11 @@ func NewVM() *VM {
 	C.clua_initState(L)
 	vm := &VM{globalL: L}
 	vm.structTbl = make(map[reflect.Type]*structInfo)
+	vm.luaRefs = make(map[int]bool)
+	vm.objCache = make(map[objKey]*refGo)
+	vm.namedTypes = make(map[string]reflect.Type)
+	vm.typeNames = make(map[reflect.Type]string)
+	vm.files = make(map[interface{}]*File)
 	return vm
 }
 
@@ -140,6 +238,9 @@ func getStructFieldValue(structValue reflect.Value, fld *structField) (value ref
 		fvalue := structValue.FieldByIndex(fld.dataIndex)
 		return fvalue
 	case METHOD_FIELD:
+		if fld.method.IsValid() {
+			return fld.method
+		}
 		pstruct := reflect.PtrTo(structValue.Type())
 		fvalue := pstruct.Method(fld.methodIndex).Func
 		return fvalue
@@ -152,10 +253,7 @@ func (state State) getStructField(structPtr reflect.Value, lkey C.int) (ret int,
 	vm := state.VM
 	structValue := structPtr.Elem()
 	t := structValue.Type()
-	info := vm.findStruct(t)
-	if info == nil {
-		return -1, fmt.Errorf("can not index a solid struct")
-	}
+	info := vm.registerStruct(t)
 
 	ltype := int(C.lua_type(L, lkey))
 	if ltype != C.LUA_TSTRING {
@@ -172,11 +270,24 @@ func (state State) getStructField(structPtr reflect.Value, lkey C.int) (ret int,
 	// </hack>
 	fld, ok := info.cache[pstr]
 	if !ok {
+		if state.indexExtension(t, lkey) {
+			return 1, nil
+		}
 		key := stringFromLua(L, lkey)
 		return -1, fmt.Errorf("not such field `%v'", key)
 	}
+	if info.policy != nil {
+		if err := info.policy.checkGet(t, stringFromLua(L, lkey), fld); err != nil {
+			return -1, err
+		}
+	}
 
 	value := getStructFieldValue(structValue, fld)
+	if info.policy != nil && info.policy.readOnly && fld.typ == DATA_FIELD {
+		// maps and slices of a read-only struct are read-only too
+		state.pushReadOnly(value)
+		return 1, nil
+	}
 	state.goToLuaValue(value)
 	return 1, nil
 }
@@ -186,10 +297,7 @@ func (state State) setStructField(structPtr reflect.Value, lkey C.int, lvalue C.
 	vm := state.VM
 	structValue := structPtr.Elem()
 	t := structValue.Type()
-	info := vm.findStruct(t)
-	if info == nil {
-		return -1, fmt.Errorf("can not assign field of a solid struct")
-	}
+	info := vm.registerStruct(t)
 
 	ltype := int(C.lua_type(L, lkey))
 	if ltype != C.LUA_TSTRING {
@@ -205,6 +313,9 @@ func (state State) setStructField(structPtr reflect.Value, lkey C.int, lvalue C.
 	if fld.typ != DATA_FIELD {
 		return -1, fmt.Errorf("only data field is assignble, but `%v' is not !", key)
 	}
+	if err := info.policy.checkSet(t, key); err != nil {
+		return -1, err
+	}
 
 	sf := t.FieldByIndex(fld.dataIndex) // StructField 
 	value, err := state.luaToGoValue(int(lvalue), &sf.Type)
@@ -220,6 +331,16 @@ func (state State) setStructField(structPtr reflect.Value, lkey C.int, lvalue C.
 func GO_unlinkObject(ref unsafe.Pointer) {
 	node := (*refGo)(ref)
 	node.unlink()
+	if fin, ok := node.obj.(luaFinalizer); ok {
+		fin.luaFinalize()
+	}
+	if node.key.typ != nil {
+		cache := node.vm.objCache
+		// a newer userdata may already own the key
+		if cache[node.key] == node {
+			delete(cache, node.key)
+		}
+	}
 }
 
 //export GO_getObjectLength
@@ -237,11 +358,112 @@ func GO_getObjectLength(_L unsafe.Pointer, ref unsafe.Pointer) (ret int) {
 		}
 	}()
 
+	if l, ok := node.obj.(luaLengther); ok {
+		C.lua_pushinteger(L, C.lua_Integer(l.luaLen()))
+		return 1
+	}
+	if v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Slice {
+		v = v.Elem()
+	}
 	n := v.Len()
 	C.lua_pushinteger(L, C.lua_Integer(n))
 	return 1
 }
 
+//
+// set the index of the first element of go slices seen from lua,
+// it is 0 by default, and 1 makes slices behave like lua arrays
+//
+func (vm *VM) SetIndexBase(base int) {
+	vm.indexBase = base
+}
+
+//
+// set the index base of a slice type, it overrides SetIndexBase
+//
+func (vm *VM) SetTypeIndexBase(sliceType reflect.Type, base int) {
+	if vm.typeIndexBase == nil {
+		vm.typeIndexBase = make(map[reflect.Type]int)
+	}
+	vm.typeIndexBase[sliceType] = base
+}
+
+//
+// make time.Duration values integer nanoseconds in lua instead of float
+// seconds, e.g. 1500000000 instead of 1.5, as they were before durations
+// were converted. Numbers with a fraction are then not durations. Strings
+// like "1m30s" are accepted as durations either way.
+//
+func (vm *VM) SetDurationNanoseconds(on bool) {
+	vm.durationNanoseconds = on
+}
+
+func (vm *VM) indexBaseOf(sliceType reflect.Type) int {
+	if base, ok := vm.typeIndexBase[sliceType]; ok {
+		return base
+	}
+	return vm.indexBase
+}
+
+//
+// push slice[key], nil if key is out of range
+//
+func (state State) indexSlice(v reflect.Value, lkey C.int) int {
+	L := state.L
+	ltype := C.lua_type(L, lkey)
+	if ltype != C.LUA_TNUMBER {
+		if state.indexExtension(v.Type(), lkey) {
+			return 1
+		}
+		panic(fmt.Sprintf("index of slice must be a number type, here got `%v'", luaTypeName(ltype)))
+	}
+	idx := int(C.lua_tointeger(L, lkey)) - state.VM.indexBaseOf(v.Type())
+	if idx < 0 || idx >= v.Len() {
+		C.lua_pushnil(L)
+		return 1
+	}
+	value := v.Index(idx)
+	if value.Kind() == reflect.Struct {
+		// reference the element, so that field writes persist
+		value = value.Addr()
+	}
+	state.goToLuaValue(value)
+	return 1
+}
+
+//
+// slice[key] = value, the value is appended when key is right after the
+// last element and the slice is held by the pointer ptr
+//
+func (state State) newindexSlice(v reflect.Value, ptr reflect.Value, lkey C.int, lvalue C.int) int {
+	L := state.L
+	ltype := C.lua_type(L, lkey)
+	if ltype != C.LUA_TNUMBER {
+		panic(fmt.Sprintf("index of slice must be a number type, got `%v'", luaTypeName(ltype)))
+	}
+	tElem := v.Type().Elem()
+	value, err := state.luaToGoValue(int(lvalue), &tElem)
+	if err != nil {
+		panic(fmt.Sprintf("error when assign to slice member, %s", err.Error()))
+	}
+	if !value.IsValid() {
+		value = reflect.Zero(tElem)
+	}
+	base := state.VM.indexBaseOf(v.Type())
+	idx := int(C.lua_tointeger(L, lkey)) - base
+	n := v.Len()
+	switch {
+	case idx >= 0 && idx < n:
+		v.Index(idx).Set(value)
+	case idx == n && ptr.IsValid():
+		v.Set(reflect.Append(v, value))
+	default:
+		panic(fmt.Sprintf("index %v out of range [%v, %v] of slice",
+			idx+base, base, n-1+base))
+	}
+	return 0
+}
+
 //export GO_indexObject
 func GO_indexObject(_L unsafe.Pointer, ref unsafe.Pointer, lkey C.int) (ret int) {
 	L := (*C.lua_State)(_L)
@@ -259,16 +481,13 @@ func GO_indexObject(_L unsafe.Pointer, ref unsafe.Pointer, lkey C.int) (ret int)
 		}
 	}()
 
-	ltype := C.lua_type(L, lkey)
+	if view, ok := node.obj.(*readOnlyView); ok {
+		return state.indexView(view, lkey)
+	}
+
 	switch k {
 	case reflect.Slice:
-		if ltype == C.LUA_TNUMBER {
-			idx := int(C.lua_tointeger(L, lkey))
-			value := v.Index(idx)
-			state.goToLuaValue(value)
-			return 1
-		}
-		panic(fmt.Sprintf("index of slice must be a number type, here got `%v'", luaTypeName(ltype)))
+		return state.indexSlice(v, lkey)
 	case reflect.Map:
 		keyType := t.Key()
 		key, err := state.luaToGoValue(int(lkey), &keyType)
@@ -283,6 +502,9 @@ func GO_indexObject(_L unsafe.Pointer, ref unsafe.Pointer, lkey C.int) (ret int)
 		state.goToLuaValue(value)
 		return 1
 	case reflect.Ptr:
+		if t.Elem().Kind() == reflect.Slice {
+			return state.indexSlice(v.Elem(), lkey)
+		}
 		if t.Elem().Kind() == reflect.Struct {
 			ret, err := state.getStructField(v, lkey)
 			if err != nil {
@@ -303,8 +525,6 @@ func GO_newindexObject(_L unsafe.Pointer, ref unsafe.Pointer, lkey C.int, lvalue
 	vm := node.vm
 	state := State{vm, L}
 	v := reflect.ValueOf(node.obj)
-	t := v.Type()
-	k := v.Kind()
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -313,20 +533,24 @@ func GO_newindexObject(_L unsafe.Pointer, ref unsafe.Pointer, lkey C.int, lvalue
 		}
 	}()
 
-	ltype := C.lua_type(L, lkey)
+	return state.newindexObject(v, lkey, lvalue)
+}
+
+//
+// obj[key] = value, panic if failed
+//
+func (state State) newindexObject(v reflect.Value, lkey C.int, lvalue C.int) int {
+	L := state.L
+	t := v.Type()
+	k := v.Kind()
+
+	if t == typeOfReadOnlyView {
+		panic(fmt.Sprintf("attempt to modify a %v", v.Interface()))
+	}
+
 	switch k {
 	case reflect.Slice:
-		if ltype == C.LUA_TNUMBER {
-			tElem := t.Elem()
-			value, err := state.luaToGoValue(int(lvalue), &tElem)
-			if err != nil {
-				panic(fmt.Sprintf("error when assign to slice member, %s", err.Error()))
-			}
-			idx := int(C.lua_tointeger(L, lkey))
-			v.Index(idx).Set(value)
-			return 0
-		}
-		panic(fmt.Sprintf("index of slice must be a number type, got `%v'", luaTypeName(ltype)))
+		return state.newindexSlice(v, reflect.Value{}, lkey, lvalue)
 	case reflect.Map:
 		keyType := t.Key()
 		key, err := state.luaToGoValue(int(lkey), &keyType)
@@ -345,6 +569,9 @@ func GO_newindexObject(_L unsafe.Pointer, ref unsafe.Pointer, lkey C.int, lvalue
 		}
 		return 0
 	case reflect.Ptr:
+		if t.Elem().Kind() == reflect.Slice {
+			return state.newindexSlice(v.Elem(), v, lkey, lvalue)
+		}
 		if t.Elem().Kind() == reflect.Struct {
 			_, err := state.setStructField(v, lkey, lvalue)
 			if err != nil {
@@ -359,11 +586,27 @@ func GO_newindexObject(_L unsafe.Pointer, ref unsafe.Pointer, lkey C.int, lvalue
 }
 
 //export GO_objectToString
-func GO_objectToString(_L unsafe.Pointer, ref unsafe.Pointer) int {
+func GO_objectToString(_L unsafe.Pointer, ref unsafe.Pointer) (ret int) {
 	L := (*C.lua_State)(_L)
 	node := (*refGo)(ref)
 	obj := node.obj
-	s := fmt.Sprintf("go object: %v at %p", reflect.TypeOf(obj).Kind(), &obj)
+
+	defer func() {
+		if r := recover(); r != nil {
+			pushStringToLua(L, fmt.Sprintf("error when convert go object to string: %v", r))
+			ret = -1
+		}
+	}()
+
+	var s string
+	switch x := obj.(type) {
+	case fmt.Stringer:
+		s = x.String()
+	case error:
+		s = x.Error()
+	default:
+		s = fmt.Sprintf("go object: %v at %p", reflect.TypeOf(obj).Kind(), &obj)
+	}
 	pushStringToLua(L, s)
 	return 1
 }
@@ -386,16 +629,51 @@ func safeCall(obj reflect.Value, in []reflect.Value) (ok bool, out []reflect.Val
 func (state State) safeRawCall(objValue reflect.Value) (ret int) {
 	defer func() {
 		if r := recover(); r != nil {
+			if e, ok := r.(stateError); ok {
+				pushStringToLua(state.L, string(e))
+				ret = -1
+				return
+			}
 			pushStringToLua(state.L, fmt.Sprintf("error when call raw function: %v", r))
 			ret = -1
 		}
 	}()
-	fn := objValue.Interface().(func(State) int)
-	return fn(state)
+	switch fn := objValue.Interface().(type) {
+	case func(State) int:
+		return fn(state)
+	case func(State) (int, error):
+		n, err := fn(state)
+		if err != nil {
+			pushStringToLua(state.L, err.Error())
+			return -1
+		}
+		return n
+	}
+	pushStringToLua(state.L, fmt.Sprintf("bad raw function type `%v'", objValue.Type()))
+	return -1
+}
+
+//
+// wrap a raw method `func(*T, State) int' or `func(*T, State) (int, error)'
+// as a raw function, the receiver is at 2
+//
+func rawMethodFunc(method reflect.Value) func(State) int {
+	recvType := method.Type().In(0)
+	return func(state State) int {
+		recv, err := state.luaToGoValue(2, &recvType)
+		if err != nil || !recv.IsValid() {
+			state.Errorf("raw method needs a receiver of type `%v'", recvType)
+		}
+		out := method.Call([]reflect.Value{recv, reflect.ValueOf(state)})
+		if len(out) == 2 && !out[1].IsNil() {
+			state.Error(out[1].Interface().(error).Error())
+		}
+		return int(out[0].Int())
+	}
 }
 
-func pushCallArgError(L *C.lua_State, idx int, err error) {
-	pushStringToLua(L, fmt.Sprintf("call go func error: arg #%v,", idx)+err.Error())
+func callArgError(idx int, err error) string {
+	return fmt.Sprintf("call go func error: arg #%v,", idx) + err.Error()
 }
 
 //export GO_callObject
@@ -408,17 +686,48 @@ func GO_callObject(_L unsafe.Pointer, ref unsafe.Pointer) int {
 	v := reflect.ValueOf(obj)
 	k := v.Kind()
 
+	if p := vm.profiler; p != nil && k == reflect.Func {
+		defer p.callGo(state, v)()
+	}
+
 	if k != reflect.Func {
 		pushStringToLua(L, fmt.Sprintf("try to call a non-function go object, type `%v'", k))
 		return -1
 	}
 
+	if vm.beforeCall != nil || vm.afterCall != nil || vm.metrics.Load() != nil {
+		return state.observedCall(node, v)
+	}
+	return state.callGoFunc(v, nil)
+}
+
+//
+// call the go function v with the arguments on the lua stack, and push
+// its results. info is filled for the call hooks when it is not nil.
+//
+func (state State) callGoFunc(v reflect.Value, info *CallInfo) int {
+	L := state.L
+	fail := func(msg string) int {
+		pushStringToLua(L, msg)
+		if info != nil {
+			info.Err = errors.New(msg)
+		}
+		return -1
+	}
+
 	t := v.Type()
 	ningo := t.NumIn()
-	if ningo == 1 {
-		if t.In(0) == reflect.TypeOf(state) {
-			return state.safeRawCall(v)
+	if ningo == 1 && t.In(0) == reflect.TypeOf(state) {
+		if info != nil {
+			if err := state.VM.callBefore(info); err != nil {
+				return fail(err.Error())
+			}
+		}
+		ret := state.safeRawCall(v)
+		if ret < 0 && info != nil {
+			info.Err = errors.New(state.errorStringAt(-1))
 		}
+		return ret
 	}
 
 	ltop := int(C.lua_gettop(L))
@@ -429,8 +738,7 @@ func GO_callObject(_L unsafe.Pointer, ref unsafe.Pointer) int {
 			tin := t.In(i)
 			value, err := state.luaToGoValue(ilua, &tin)
 			if err != nil {
-				pushCallArgError(L, ilua, err)
-				return -1
+				return fail(callArgError(ilua, err))
 			}
 			in[i] = value
 			ilua++
@@ -441,8 +749,7 @@ func GO_callObject(_L unsafe.Pointer, ref unsafe.Pointer) int {
 		for i := 0; i < nvarg; i++ {
 			value, err := state.luaToGoValue(ilua, &vargType)
 			if err != nil {
-				pushCallArgError(L, ilua, err)
-				return -1
+				return fail(callArgError(ilua, err))
 			}
 			if value.IsValid() {
 				varg.Index(i).Set(value)
@@ -455,66 +762,113 @@ func GO_callObject(_L unsafe.Pointer, ref unsafe.Pointer) int {
 			tin := t.In(i)
 			value, err := state.luaToGoValue(ilua, &tin)
 			if err != nil {
-				pushCallArgError(L, ilua, err)
-				return -1
+				return fail(callArgError(ilua, err))
 			}
 			in[i] = value
 			ilua++
 		}
 	}
 
+	if info != nil {
+		info.setArgs(t, in)
+		if err := state.VM.callBefore(info); err != nil {
+			return fail(err.Error())
+		}
+	}
+
 	ok, out, err := safeCall(v, in)
 	if !ok {
-		pushStringToLua(L, "call go func error: "+err.Error())
-		return -1
+		return fail("call go func error: " + err.Error())
+	}
+	if info != nil {
+		info.setResults(t, out)
 	}
 
 	for _, value := range out {
-		state.goToLuaValue(value)
+		if _, err := state.pushGoValue(value); err != nil {
+			return fail("call go func error: " + err.Error())
+		}
 	}
 
 	return len(out)
 }
 
 func callLuaFuncUtil(state State, inv []reflect.Value, nout int) ([]interface{}, error) {
+	values, err := callLuaFuncValues(state, inv, nout, nil)
+	result := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		if value.IsValid() {
+			result = append(result, value.Interface())
+		} else {
+			result = append(result, nil)
+		}
+	}
+	return result, err
+}
+
+//
+// call the lua function below the arguments inv, and convert its results.
+// With outTypes, the results are converted to them like the arguments of
+// go functions, a nil result is the zero value, and nout is len(outTypes).
+//
+func callLuaFuncValues(state State, inv []reflect.Value, nout int, outTypes []reflect.Type) ([]reflect.Value, error) {
 	L := state.L
+	state.VM.DrainReleases()
 	bottom := int(C.lua_gettop(L))
 
-	var result []interface{}
+	if outTypes != nil {
+		nout = len(outTypes)
+	}
 	var nluaout C.int
 	var nin C.int
 	if nout >= 0 {
 		nluaout = C.int(nout)
-		result = make([]interface{}, 0, nout)
 	} else {
 		nluaout = C.LUA_MULTRET
-		result = make([]interface{}, 0, 1)
 	}
 	if inv != nil {
+		C.lua_checkstack(L, C.int(len(inv)))
 		for _, iarg := range inv {
-			state.goToLuaValue(iarg)
+			if _, err := state.pushGoValue(iarg); err != nil {
+				// drop the function and the pushed arguments
+				C.lua_settop(L, C.int(bottom-1))
+				return nil, err
+			}
 		}
 		nin = C.int(len(inv))
 	} else {
 		nin = 0
 	}
-	ret := int(C.lua_pcall(L, nin, nluaout, 0))
+	errfunc := C.int(0)
+	if state.VM.snapshotDepth > 0 {
+		state.pushSnapshotHandler()
+		C.lua_insert(L, C.int(bottom))
+		errfunc = C.int(bottom)
+		bottom++
+		defer C.lua_remove(L, errfunc)
+	}
+	ret := int(C.lua_pcall(L, nin, nluaout, errfunc))
 	if ret != 0 {
-		err := stringFromLua(L, -1)
+		err := state.errorStringAt(-1)
 		C.lua_settop(L, -2)
-		return result, errors.New(err)
+		return nil, state.VM.takeSnapshot(err)
 	}
+	defer C.lua_settop(L, C.int(bottom-1))
+
 	top := int(C.lua_gettop(L))
+	result := make([]reflect.Value, 0, top+1-bottom)
 	for i := bottom; i <= top; i++ {
-		value, _ := state.luaToGoValue(i, nil)
-		if value.IsValid() {
-			result = append(result, value.Interface())
-		} else {
-			result = append(result, nil)
+		if outTypes == nil {
+			value, _ := state.luaToGoValue(i, nil)
+			result = append(result, value)
+			continue
 		}
+		value, err := state.luaToTypedValue(i, outTypes[i-bottom])
+		if err != nil {
+			return nil, fmt.Errorf("result #%v: %v", i-bottom+1, err)
+		}
+		result = append(result, value)
 	}
-	rnout := C.int(top + 1 - bottom)
-	C.lua_settop(L, -rnout-1)
 	return result, nil
 }
 
@@ -540,6 +894,55 @@ func (vm *VM) EvalStringWithError(str string, arg ...interface{}) ([]interface{}
 	return callLuaFuncUtil(state, nil, nout)
 }
 
+//
+// like EvalStringWithError, the chunk is named `name' in error messages,
+// tracebacks, profiles and coverage reports
+//
+func (vm *VM) EvalNamedString(name, str string, arg ...interface{}) ([]interface{}, error) {
+	L := vm.globalL
+	state := State{vm, L}
+	s, n := stringToC(str)
+	bottom := C.lua_gettop(L)
+	defer C.lua_settop(L, bottom)
+
+	if len(name) == 0 || (name[0] != '@' && name[0] != '=') {
+		name = "@" + name
+	}
+	chunkname := C.CString(name)
+	defer C.free(unsafe.Pointer(chunkname))
+	ret := int(C.luaL_loadbuffer(L, s, n, chunkname))
+	if ret != 0 {
+		err := stringFromLua(L, -1)
+		return make([]interface{}, 0), errors.New(err)
+	}
+
+	nout := -1
+	if len(arg) > 0 {
+		if x, ok := arg[0].(int); ok {
+			nout = x
+		}
+	}
+	return callLuaFuncUtil(state, nil, nout)
+}
+
+//
+// run a lua chunk of the binding itself, the args are passed as `...'
+//
+func (vm *VM) evalWithArgs(str string, arg ...interface{}) error {
+	L := vm.globalL
+	state := State{vm, L}
+	s, n := stringToC(str)
+	bottom := C.lua_gettop(L)
+	defer C.lua_settop(L, bottom)
+
+	ret := int(C.luaL_loadbuffer(L, s, n, nil))
+	if ret != 0 {
+		return errors.New(stringFromLua(L, -1))
+	}
+	_, err := callLuaFunc(state, arg, 0)
+	return err
+}
+
 func (vm *VM) EvalString(str string, arg ...interface{}) []interface{} {
 	result, _ := vm.EvalStringWithError(str, arg...)
 	return result
@@ -590,9 +993,55 @@ func (vm *VM) EvalBuffer(reader io.Reader, arg ...interface{}) []interface{} {
 	return result
 }
 
+func (vm *VM) unref(ref int) {
+	if vm.luaRefs[ref] {
+		delete(vm.luaRefs, ref)
+		delete(vm.luaRefStacks, ref)
+		C.luaL_unref(vm.globalL, C.LUA_REGISTRYINDEX, C.int(ref))
+	}
+}
+
+//
+// release lua references whose RefLua was garbage collected.
+// It is called before every Eval/Call, and it is safe to call it
+// explicitly from the goroutine that owns the VM.
+//
+func (vm *VM) DrainReleases() int {
+	refs := vm.releases.take()
+	if vm.globalL == nil {
+		return 0
+	}
+	n := 0
+	for _, ref := range refs {
+		if vm.luaRefs[ref] {
+			vm.unref(ref)
+			n++
+		}
+	}
+	return n
+}
+
+//
+// close the VM, all outstanding RefLua become invalid
+//
 func (vm *VM) Close() {
+	vm.releases.close()
+	if vm.debugger != nil {
+		vm.StopDebugger()
+	}
+	vm.profiler = nil
+	vm.cover = nil
+	vm.updateHook()
 	C.lua_close(vm.globalL)
 	vm.globalL = nil
+	vm.snapshotRef = 0
+	vm.luaRefs = make(map[int]bool)
+	vm.objCache = make(map[objKey]*refGo)
+	vm.files = make(map[interface{}]*File)
+	vm.extends = nil
+	if vm.luaRefStacks != nil {
+		vm.luaRefStacks = make(map[int][]uintptr)
+	}
 }
 
 func (vm *VM) Gc(what, data int) int {
@@ -602,12 +1051,15 @@ func (vm *VM) Gc(what, data int) int {
 func (vm *VM) Openlibs() {
 	C.luaL_openlibs(vm.globalL)
 	vm.initLuaLib()
+	vm.initFileLib()
+	vm.initOutput()
 }
 
 func (vm *VM) newRefNode(obj interface{}) *refGo {
 	ref := new(refGo)
 	ref.vm = vm
 	ref.obj = obj
+	ref.stack = vm.traceStack()
 	ref.link(&vm.refLink)
 	return ref
 }
@@ -629,17 +1081,20 @@ func checkFunc(fnType reflect.Type) (bool, error) {
 		wrongRawFunc = true
 	} else if foundState == 1 {
 		nout := fnType.NumOut()
-		if nin != 1 || nout != 1 {
+		if nin != 1 || nout < 1 || nout > 2 {
 			wrongRawFunc = true
 		} else {
 			if fnType.Out(0).Kind() != reflect.Int {
 				wrongRawFunc = true
 			}
+			if nout == 2 && fnType.Out(1) != typeOfError {
+				wrongRawFunc = true
+			}
 		}
 	}
 
 	if wrongRawFunc {
-		return false, fmt.Errorf("raw function must be type: `func(State) int'")
+		return false, fmt.Errorf("raw function must be type: `func(State) int' or `func(State) (int, error)'")
 	}
 
 	return true, nil
@@ -697,11 +1152,13 @@ func (vm *VM) AddFunc(name string, fn interface{}) (bool, error) {
 
 	L := vm.globalL
 	state := State{vm, L}
+	bottom := C.lua_gettop(L)
+	defer C.lua_settop(L, bottom)
 
 	if len(path) <= 0 {
 		// _G[a] = fn
 		pushStringToLua(L, baseName)
-		state.pushObjToLua(fn)
+		state.pushFuncToLua(name, fn)
 		C.lua_settable(vm.globalL, C.LUA_GLOBALSINDEX)
 		return true, nil
 	}
@@ -712,11 +1169,100 @@ func (vm *VM) AddFunc(name string, fn interface{}) (bool, error) {
 		return false, err
 	}
 	pushStringToLua(L, baseName)
-	state.pushObjToLua(fn)
+	state.pushFuncToLua(name, fn)
 	C.lua_settable(vm.globalL, -3)
 	return true, nil
 }
 
+//
+// make the function pointed to by fnPtr call the lua function name, e.g.
+//
+//	var area func(w, h float64) (float64, error)
+//	vm.Bind("geo.area", &area)
+//
+// The arguments are passed like the arguments of Function.Call, and the
+// results are converted like CallInto. Lua errors are returned by the
+// last result of type error, or panic when there is no such result.
+//
+func (vm *VM) Bind(name string, fnPtr interface{}) error {
+	ptr := reflect.ValueOf(fnPtr)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Func {
+		return fmt.Errorf("Bind needs a pointer to a function, got `%v'", reflect.TypeOf(fnPtr))
+	}
+	fnType := ptr.Elem().Type()
+
+	L := vm.globalL
+	state := State{vm, L}
+	bottom := C.lua_gettop(L)
+	defer C.lua_settop(L, bottom)
+
+	C.lua_pushvalue(L, C.LUA_GLOBALSINDEX)
+	for _, key := range strings.Split(name, ".") {
+		if C.lua_type(L, -1) != C.LUA_TTABLE {
+			return fmt.Errorf("lua function `%v' not found", name)
+		}
+		pushStringToLua(L, key)
+		C.lua_rawget(L, -2)
+	}
+	if C.lua_type(L, -1) != C.LUA_TFUNCTION {
+		return fmt.Errorf("`%v' is not a lua function", name)
+	}
+	lfn := state.NewLuaFunction(-1)
+
+	nout := fnType.NumOut()
+	withError := nout > 0 && fnType.Out(nout-1) == typeOfError
+	if withError {
+		nout--
+	}
+	outTypes := make([]reflect.Type, nout)
+	for i := range outTypes {
+		outTypes[i] = fnType.Out(i)
+	}
+
+	fn := reflect.MakeFunc(fnType, func(in []reflect.Value) []reflect.Value {
+		if fnType.IsVariadic() && len(in) > 0 {
+			last := in[len(in)-1]
+			in = in[:len(in)-1]
+			for i := 0; i < last.Len(); i++ {
+				in = append(in, last.Index(i))
+			}
+		}
+
+		var values []reflect.Value
+		var err error
+		if lfn.valid() {
+			vm := lfn.VM
+			state := State{vm, vm.globalL}
+			lfn.PushValue(state)
+			values, err = callLuaFuncValues(state, in, 0, outTypes)
+		} else {
+			err = fmt.Errorf("cannot call a released lua function")
+		}
+		if err != nil && !withError {
+			panic(fmt.Sprintf("call lua function `%v' failed: %v", name, err))
+		}
+
+		out := make([]reflect.Value, 0, len(outTypes)+1)
+		for i, typ := range outTypes {
+			if err != nil {
+				out = append(out, reflect.Zero(typ))
+			} else {
+				out = append(out, values[i])
+			}
+		}
+		if withError {
+			errValue := reflect.Zero(typeOfError)
+			if err != nil {
+				errValue = reflect.ValueOf(&err).Elem()
+			}
+			out = append(out, errValue)
+		}
+		return out
+	})
+	ptr.Elem().Set(fn)
+	return nil
+}
+
 func (vm *VM) AddFuncList(prefix string, fnlist []base.KeyValue) (bool, error) {
 	for _, kv := range fnlist {
 		name := prefix + "." + kv.Key
@@ -768,6 +1314,22 @@ func parseStructMethods(sinfo *structInfo, typ reflect.Type) {
 			sinfo.fields[name] = finfo
 		}
 	}
+
+	if methoder, ok := reflect.New(sinfo.typ).Interface().(luaMethoder); ok {
+		for luaName, method := range methoder.luaMethods() {
+			mvalue := reflect.ValueOf(method)
+			mtype := mvalue.Type()
+			if mtype.NumIn() == 2 && mtype.In(1) == reflect.TypeOf(State{}) {
+				mvalue = reflect.ValueOf(rawMethodFunc(mvalue))
+			}
+			sinfo.fields[luaName] = &structField{
+				sinfo:  sinfo,
+				name:   luaName,
+				typ:    METHOD_FIELD,
+				method: mvalue,
+			}
+		}
+	}
 }
 
 func (vm *VM) AddStructList(structs interface{}) (bool, error) {
@@ -783,18 +1345,138 @@ func (vm *VM) AddStructList(structs interface{}) (bool, error) {
 			continue
 		}
 
-		if vm.findStruct(stype) != nil {
-			continue
+		vm.registerStruct(stype)
+	}
+	return true, nil
+}
+
+//
+// get field infomation of a struct type, it is parsed the first time
+// a value of the type is indexed from lua
+//
+func (vm *VM) registerStruct(stype reflect.Type) *structInfo {
+	if sinfo := vm.findStruct(stype); sinfo != nil {
+		return sinfo
+	}
+
+	sinfo := vm.addStruct(stype, newStruct(stype))
+	namePath := make([]string, 0)
+	indexPath := make([]int, 0)
+	parseStructMembers(sinfo, stype, namePath, indexPath)
+
+	parseStructMethods(sinfo, stype)
+
+	sinfo.makeFieldsIndexCache(vm)
+	return sinfo
+}
+
+func (vm *VM) registerReachable(typ reflect.Type, seen map[reflect.Type]bool) {
+	if seen[typ] {
+		return
+	}
+	seen[typ] = true
+
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Chan:
+		vm.registerReachable(typ.Elem(), seen)
+	case reflect.Map:
+		vm.registerReachable(typ.Key(), seen)
+		vm.registerReachable(typ.Elem(), seen)
+	case reflect.Func:
+		for i := 0; i < typ.NumIn(); i++ {
+			vm.registerReachable(typ.In(i), seen)
 		}
+		for i := 0; i < typ.NumOut(); i++ {
+			vm.registerReachable(typ.Out(i), seen)
+		}
+	case reflect.Struct:
+		vm.registerStruct(typ)
+		for i := 0; i < typ.NumField(); i++ {
+			sf := typ.Field(i)
+			if sf.PkgPath == "" {
+				vm.registerReachable(sf.Type, seen)
+			}
+		}
+		ptyp := reflect.PtrTo(typ)
+		for i := 0; i < ptyp.NumMethod(); i++ {
+			vm.registerReachable(ptyp.Method(i).Type, seen)
+		}
+	}
+}
+
+//
+// register struct types, with every struct type reachable from
+// their fields and methods
+//
+func (vm *VM) RegisterTypes(types ...reflect.Type) {
+	seen := make(map[reflect.Type]bool)
+	for _, typ := range types {
+		vm.registerReachable(typ, seen)
+	}
+}
 
-		sinfo := vm.addStruct(stype, newStruct(stype))
-		namePath := make([]string, 0)
-		indexPath := make([]int, 0)
-		parseStructMembers(sinfo, stype, namePath, indexPath)
+//
+// generic form of RegisterTypes, e.g. lua.RegisterType[Point](vm)
+//
+func RegisterType[T any](vm *VM) {
+	vm.RegisterTypes(reflect.TypeOf((*T)(nil)).Elem())
+}
 
-		parseStructMethods(sinfo, stype)
+//
+// register a type under a lua name. The name is callable from lua as a
+// constructor, `Point{X=1, Y=2}' creates a *Point, and the name can be
+// used with golang.New, golang.Is and golang.TypeOf.
+//
+func (vm *VM) AddType(name string, typ reflect.Type) (bool, error) {
+	if typ == nil {
+		return false, fmt.Errorf("AddType needs a type")
+	}
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if old, ok := vm.namedTypes[name]; ok && old != typ {
+		return false, fmt.Errorf("type name `%v' is already used by `%v'", name, old)
+	}
 
-		sinfo.makeFieldsIndexCache(vm)
+	ctor := func(state State) int {
+		return state.newObject(typ, 2)
+	}
+	if ok, err := vm.AddFunc(name, ctor); !ok {
+		return ok, err
+	}
+
+	vm.namedTypes[name] = typ
+	vm.typeNames[typ] = name
+	if typ.Kind() == reflect.Struct {
+		vm.RegisterTypes(typ)
 	}
 	return true, nil
 }
+
+//
+// push a new *typ, fields are filled from the table at linit if any
+//
+func (state State) newObject(typ reflect.Type, linit int) int {
+	L := state.L
+	ptr := reflect.New(typ)
+	switch C.lua_type(L, C.int(linit)) {
+	case C.LUA_TNONE, C.LUA_TNIL:
+	case C.LUA_TTABLE:
+		if typ.Kind() != reflect.Struct {
+			C.lua_pushnil(L)
+			pushStringToLua(L, fmt.Sprintf("can not init `%v' from a table", typ))
+			return 2
+		}
+		if err := state.luaTableToStruct(linit, ptr); err != nil {
+			C.lua_pushnil(L)
+			pushStringToLua(L, err.Error())
+			return 2
+		}
+	default:
+		C.lua_pushnil(L)
+		pushStringToLua(L, "fields of new object must be a table")
+		return 2
+	}
+	state.goToLuaValue(ptr)
+	return 1
+}
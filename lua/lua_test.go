@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"goinfi/base"
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 type Runner struct {
@@ -498,3 +500,259 @@ func TestLua_keyvalue(t *testing.T) {
 	expect = []interface{}{"a", 1.0, "b", 2.0}
 	r.AssertEqual(result[1], expect)
 }
+
+func TestLua_refrelease(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	// refs dropped without Release are queued by the finalizer
+	for i := 0; i < 10; i++ {
+		r.E(`return function() end`)
+	}
+	r.AssertEqual(len(r.vm.luaRefs), 10)
+	n := 0
+	for i := 0; i < 10 && n < 10; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+		n += r.vm.DrainReleases()
+	}
+	r.AssertEqual(n, 10)
+	r.AssertEqual(len(r.vm.luaRefs), 0)
+
+	// released explicitly, then collected: must not unref twice
+	result := r.E(`return {}`)
+	tbl := result[0].(*Table)
+	tbl.Release()
+	r.AssertEqual(len(r.vm.luaRefs), 0)
+}
+
+func TestLua_refafterclose(t *testing.T) {
+	vm := NewVM()
+	vm.Openlibs()
+	result, _ := vm.EvalStringWithError(`return function() return 1 end, {1}`)
+	fn := result[0].(*Function)
+	tbl := result[1].(*Table)
+	vm.Close()
+
+	_, err := fn.Call()
+	if err == nil {
+		t.Errorf("call after close must fail")
+	}
+	if _, err := tbl.GetWithError(1); err == nil {
+		t.Errorf("get after close must fail")
+	}
+	fn.Release()
+	tbl.Release()
+	if vm.DrainReleases() != 0 {
+		t.Errorf("closed vm must not release")
+	}
+}
+
+func TestLua_identity(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.AddStructList(allMyStruct{})
+	p := &Point{1, 2}
+	m := map[string]int{"a": 1}
+	r.vm.AddFunc("GetPoint", func() *Point { return p })
+	r.vm.AddFunc("GetMap", func() map[string]int { return m })
+
+	result := r.E(`
+		local a, b = GetPoint(), GetPoint()
+		local set = {}
+		set[a] = 'point'
+		return a == b, set[b], GetMap() == GetMap()
+	`)
+	expect := []interface{}{true, "point", true}
+	r.AssertEqual(result, expect)
+
+	// a collected userdata is replaced by a new one
+	before := len(r.vm.objCache)
+	r.E(`collectgarbage('collect')`)
+	r.AssertEqual(len(r.vm.objCache) < before, true)
+	result = r.E(`
+		local a = GetPoint()
+		collectgarbage('collect')
+		return a == GetPoint(), a.X
+	`)
+	expect = []interface{}{true, 1.0}
+	r.AssertEqual(result, expect)
+}
+
+type Segment struct {
+	From Point
+	To   *Point
+	Tags []*Rect
+}
+
+func (s *Segment) Origin() *DoublePoint {
+	return new(DoublePoint)
+}
+
+func TestLua_registertype(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	// struct types are parsed lazily on first use
+	r.vm.AddFunc("NewPoint", NewPoint)
+	result := r.E(`
+		local p = NewPoint(3, 4)
+		p.X = 5
+		return p.X, p:SumXY()
+	`)
+	expect := []interface{}{5.0, 9.0}
+	r.AssertEqual(result, expect)
+
+	// every struct reachable from fields and methods is registered
+	RegisterType[Segment](r.vm)
+	for _, typ := range []reflect.Type{
+		reflect.TypeOf(Segment{}), reflect.TypeOf(Point{}),
+		reflect.TypeOf(Rect{}), reflect.TypeOf(DoublePoint{}),
+	} {
+		r.AssertNoEqual(r.vm.findStruct(typ), (*structInfo)(nil))
+	}
+}
+
+func TestLua_indexbase(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	ints := []int{1, 2, 3}
+	names := []string{"a", "b"}
+	r.vm.AddFunc("GetInts", func() *[]int { return &ints })
+	r.vm.AddFunc("GetNames", func() []string { return names })
+	r.vm.SetIndexBase(1)
+	r.vm.SetTypeIndexBase(reflect.TypeOf(names), 0)
+
+	result = r.E(`
+		local s = GetInts()
+		return #s, s[1], s[3], s[0], s[4]
+	`)
+	expect = []interface{}{3.0, 1.0, 3.0, nil, nil}
+	r.AssertEqual(result, expect)
+
+	// append through the pointer
+	result = r.E(`
+		local s = GetInts()
+		s[#s+1] = 4
+		s[1] = 10
+		return #s, s[4]
+	`)
+	expect = []interface{}{4.0, 4.0}
+	r.AssertEqual(result, expect)
+	r.AssertEqual(ints, []int{10, 2, 3, 4})
+
+	result = r.E(`
+		local s = GetNames()
+		return s[0], s[1], s[2]
+	`)
+	expect = []interface{}{"a", "b", nil}
+	r.AssertEqual(result, expect)
+
+	// slices not held by pointer do not grow
+	r.E_MustError(`
+		local s = GetNames()
+		s[#s] = 'c'
+	`)
+	r.E_MustError(`
+		local s = GetInts()
+		s[#s+2] = 6
+	`)
+}
+
+func TestLua_time(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	start := time.Date(2013, 1, 30, 12, 0, 0, 0, time.UTC)
+	r.vm.AddFunc("Start", func() time.Time { return start })
+	r.vm.AddFunc("Elapsed", func(t time.Time) time.Duration { return t.Sub(start) })
+	r.vm.AddFunc("Sleep", func(d time.Duration) time.Duration { return d })
+
+	result = r.E(`
+		local t = Start()
+		local later = t:Add(90)
+		return t:Unix(), t:Format("2006-01-02"), later:Sub(t), Elapsed(later)
+	`)
+	expect = []interface{}{float64(start.Unix()), "2013-01-30", 90.0, 90.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		return Elapsed(1359547260.5), Elapsed("2013-01-30T12:02:00Z"),
+			Sleep("1m30s"), Sleep(0.25), Sleep(golang.Duration("2s"))
+	`)
+	expect = []interface{}{60.5, 120.0, 90.0, 0.25, 2.0}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		return golang.Time(0):Unix(), golang.Now():After(Start())
+	`)
+	expect = []interface{}{0.0, true}
+	r.AssertEqual(result, expect)
+
+	r.E_MustError(`Elapsed("yesterday")`)
+
+	// integer nanoseconds on demand
+	r.vm.SetDurationNanoseconds(true)
+	result = r.E(`return Sleep(1500), Sleep("1ms"), Start():Add(1e9):Sub(Start())`)
+	expect = []interface{}{1500.0, 1e6, 1e9}
+	r.AssertEqual(result, expect)
+	r.E_MustError(`Sleep(1.5)`)
+}
+
+func TestLua_typedCall(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	result := r.E(`
+		geo = {}
+		function geo.area(w, h) return w * h end
+		function geo.rect(x, y) return {Left = x, Top = y, Width = 2}, {1, 2, 3}, {a = 1} end
+		function geo.fail() error("failed") end
+		function geo.join(sep, ...) return table.concat({...}, sep) end
+		return geo.rect
+	`)
+	fn := result[0].(*Function)
+
+	var rect Rect
+	var ints []int
+	var m map[string]int
+	var missing string
+	if err := fn.CallInto([]interface{}{3, 4}, &rect, &ints, &m, &missing); err != nil {
+		t.Fatal(err)
+	}
+	r.AssertEqual(rect, Rect{Left: 3, Top: 4, Width: 2})
+	r.AssertEqual(ints, []int{1, 2, 3})
+	r.AssertEqual(m, map[string]int{"a": 1})
+	r.AssertEqual(missing, "")
+
+	p, n, err := Call2[*Rect, []int](fn, 1, 2)
+	r.AssertEqual(err, nil)
+	r.AssertEqual(p.Top, 2)
+	r.AssertEqual(n, []int{1, 2, 3})
+	if _, err := Call1[string](fn, 1, 2); err == nil {
+		t.Errorf("converting a table to string must fail")
+	}
+
+	var area func(w, h int) int
+	var fail func() (int, error)
+	var join func(sep string, parts ...string) string
+	r.AssertEqual(r.vm.Bind("geo.area", &area), nil)
+	r.AssertEqual(r.vm.Bind("geo.fail", &fail), nil)
+	r.AssertEqual(r.vm.Bind("geo.join", &join), nil)
+	r.AssertEqual(area(3, 4), 12)
+	r.AssertEqual(join("-", "a", "b"), "a-b")
+	if _, err := fail(); err == nil {
+		t.Errorf("fail must return the lua error")
+	}
+	if err := r.vm.Bind("geo.none", &area); err == nil {
+		t.Errorf("Bind must fail on missing functions")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+//
+// lua side of the output redirection, `...' is the kind of stream and the
+// file writing to it
+//
+const luaOutputSetup = `
+local kind, stream = ...
+local select, tostring = select, tostring
+
+if kind == 'stdout' then
+	print = function(...)
+		local s = ''
+		for i = 1, select('#', ...) do
+			if i > 1 then
+				s = s .. '\t'
+			end
+			s = s .. tostring((select(i, ...)))
+		end
+		stream:write(s, '\n')
+	end
+	if io then
+		io.stdout = stream
+		io.write = function(...)
+			return stream:write(...)
+		end
+	end
+elseif io then
+	io.stderr = stream
+end
+`
+
+//
+// writes to the writer *w is pointing to when it is called
+//
+type indirectWriter struct {
+	w *io.Writer
+}
+
+func (iw indirectWriter) Write(p []byte) (int, error) {
+	return (*iw.w).Write(p)
+}
+
+//
+// send print, io.write and io.stdout of lua to w.
+// The output set before Openlibs is installed by Openlibs.
+//
+func (vm *VM) SetOutput(w io.Writer) error {
+	vm.stdout = w
+	return vm.evalWithArgs(luaOutputSetup, "stdout", NewFile(indirectWriter{&vm.stdout}))
+}
+
+//
+// send io.stderr of lua to w
+//
+func (vm *VM) SetErrorOutput(w io.Writer) error {
+	vm.stderr = w
+	return vm.evalWithArgs(luaOutputSetup, "stderr", NewFile(indirectWriter{&vm.stderr}))
+}
+
+//
+// install the lua module `log' which forwards to logger, e.g.
+//
+//	log.info("user login", {user = name, ok = true})
+//
+// chunk name and line of the caller are attached to every record
+//
+func (vm *VM) SetLogger(logger *slog.Logger) error {
+	vm.logger = logger
+	levels := []struct {
+		name  string
+		level slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"info", slog.LevelInfo},
+		{"warn", slog.LevelWarn},
+		{"error", slog.LevelError},
+	}
+	for _, lv := range levels {
+		level := lv.level
+		fn := func(state State) int {
+			return state.log(level)
+		}
+		if ok, err := vm.AddFunc("log."+lv.name, fn); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// report a panic recovered where it must not unwind through lua, through
+// the logger set by SetLogger if any
+//
+func (vm *VM) logPanic(where string, r interface{}) {
+	if vm.logger != nil {
+		vm.logger.Error("recovered panic", "in", where, "panic", fmt.Sprint(r))
+	}
+}
+
+func (vm *VM) initOutput() {
+	if vm.stdout != nil {
+		vm.SetOutput(vm.stdout)
+	}
+	if vm.stderr != nil {
+		vm.SetErrorOutput(vm.stderr)
+	}
+	if vm.logger != nil {
+		vm.SetLogger(vm.logger)
+	}
+}
+
+func (state State) log(level slog.Level) int {
+	L := state.L
+	logger := state.VM.logger
+	if logger == nil || !logger.Enabled(context.Background(), level) {
+		return 0
+	}
+
+	msg := stringFromLua(L, 2)
+	attrs := make([]slog.Attr, 0, 4)
+	var src [C.LUA_IDSIZE]C.char
+	// level 0 is the go function itself
+	line := int(C.clua_where(L, 1, &src[0], C.LUA_IDSIZE))
+	if line >= 0 {
+		attrs = append(attrs,
+			slog.String("chunk", C.GoString(&src[0])),
+			slog.Int("line", line))
+	}
+
+	if C.lua_type(L, 3) == C.LUA_TTABLE {
+		C.lua_pushnil(L)
+		for {
+			if 0 == C.lua_next(L, 3) {
+				break
+			}
+			var key string
+			if C.lua_type(L, -2) == C.LUA_TSTRING {
+				key = stringFromLua(L, -2)
+			} else {
+				vkey, _ := state.luaToGoValue(-2, nil)
+				key = fmt.Sprint(vkey.Interface())
+			}
+			var value interface{}
+			if vvalue, err := state.luaToGoValue(-1, nil); err == nil && vvalue.IsValid() {
+				value = vvalue.Interface()
+			}
+			attrs = append(attrs, slog.Any(key, value))
+			C.lua_settop(L, -2) // pop 1
+		}
+	}
+
+	logger.LogAttrs(context.Background(), level, msg, attrs...)
+	return 0
+}
@@ -0,0 +1,61 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLua_output(t *testing.T) {
+	var out, errout bytes.Buffer
+
+	vm := NewVM()
+	defer vm.Close()
+	vm.SetOutput(&out)
+	vm.Openlibs()
+	vm.SetErrorOutput(&errout)
+
+	_, err := vm.EvalStringWithError(`
+		print("a", 1, nil, true)
+		io.write("b", 2, "\n"):write("c\n")
+		io.stderr:write("oops\n")
+	`)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if out.String() != "a\t1\tnil\ttrue\nb2\nc\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if errout.String() != "oops\n" {
+		t.Errorf("unexpected error output %q", errout.String())
+	}
+
+	if _, err := vm.EvalStringWithError(`io.write({})`); err == nil {
+		t.Errorf("io.write of a table must fail")
+	}
+}
+
+func TestLua_logger(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	r.vm.SetLogger(logger)
+
+	r.vm.EvalStringWithError("log.debug('hidden')\nlog.warn('user login', {user = 'foo', ok = true})")
+	s := out.String()
+	if strings.Contains(s, "hidden") {
+		t.Errorf("debug record must be filtered: %q", s)
+	}
+	for _, want := range []string{"level=WARN", `msg="user login"`, "line=2", "user=foo", "ok=true", "chunk="} {
+		if !strings.Contains(s, want) {
+			t.Errorf("%q not in %q", want, s)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"fmt"
+	"reflect"
+)
+
+//
+// Policy restricts what lua can do with the values of a struct type.
+// Names are the names seen by lua, e.g. `P1_X' for the field X of the
+// nested struct P1, and the names given by luaMethods.
+//
+type Policy struct {
+	AllowMethods []string // only these methods can be called, all if nil
+	DenyFields   []string // fields lua can neither read nor write
+	ReadOnly     bool     // no field can be written, see below
+}
+
+//
+// The map and slice fields of a ReadOnly struct are read-only views, see
+// ReadOnly. Pointer fields are passed as they are, so the values they
+// point to are writable unless their types are read-only too.
+//
+
+type typePolicy struct {
+	allowMethods map[string]bool
+	denyFields   map[string]bool
+	readOnly     bool
+}
+
+//
+// set the policy of the struct type typ, or of the struct typ points to.
+// It replaces the previous policy of the type.
+//
+func (vm *VM) SetTypePolicy(typ reflect.Type, policy Policy) error {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return fmt.Errorf("SetTypePolicy only apply to struct types, got `%v'", typ)
+	}
+	p := &typePolicy{
+		denyFields: make(map[string]bool),
+		readOnly:   policy.ReadOnly,
+	}
+	if policy.AllowMethods != nil {
+		p.allowMethods = make(map[string]bool)
+		for _, name := range policy.AllowMethods {
+			p.allowMethods[name] = true
+		}
+	}
+	for _, name := range policy.DenyFields {
+		p.denyFields[name] = true
+	}
+	vm.registerStruct(typ).policy = p
+	return nil
+}
+
+//
+// check that lua may read the member key of a struct of type t
+//
+func (p *typePolicy) checkGet(t reflect.Type, key string, fld *structField) error {
+	if p == nil {
+		return nil
+	}
+	switch fld.typ {
+	case DATA_FIELD:
+		if p.denyFields[key] {
+			return fmt.Errorf("field `%v' of `%v' is not accessible", key, t)
+		}
+	case METHOD_FIELD:
+		if p.allowMethods != nil && !p.allowMethods[key] && !p.allowMethods[fld.name] {
+			return fmt.Errorf("method `%v' of `%v' is not allowed", key, t)
+		}
+	}
+	return nil
+}
+
+func (p *typePolicy) checkSet(t reflect.Type, key string) error {
+	if p == nil {
+		return nil
+	}
+	if p.readOnly {
+		return fmt.Errorf("`%v' is read-only", t)
+	}
+	if p.denyFields[key] {
+		return fmt.Errorf("field `%v' of `%v' is not accessible", key, t)
+	}
+	return nil
+}
+
+//
+// a read-only view of a go map or slice, see ReadOnly
+//
+type readOnlyView struct {
+	value reflect.Value
+}
+
+var typeOfReadOnlyView = reflect.TypeOf((*readOnlyView)(nil))
+
+//
+// wrap a map or a slice, or a pointer to a slice, so that lua can read it
+// but not modify it. Maps and slices read through the view are views too,
+// structs are copies, and pointers are passed as they are. Go functions
+// called from lua with the view get the wrapped value.
+//
+func ReadOnly(x interface{}) interface{} {
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Slice && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice:
+		return &readOnlyView{v}
+	}
+	return x
+}
+
+func (view *readOnlyView) luaLen() int {
+	return view.value.Len()
+}
+
+func (view *readOnlyView) String() string {
+	return fmt.Sprintf("read-only view of %v", view.value.Type())
+}
+
+//
+// the value of obj to read from, the wrapped value for views
+//
+func readableOf(obj interface{}) interface{} {
+	if view, ok := obj.(*readOnlyView); ok {
+		return view.value.Interface()
+	}
+	return obj
+}
+
+//
+// push a value read through a view
+//
+func (state State) pushReadOnly(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Map, reflect.Slice:
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		if !value.IsNil() {
+			state.pushObjToLua(&readOnlyView{value})
+			return
+		}
+	}
+	state.goToLuaValue(value)
+}
+
+func (state State) indexView(view *readOnlyView, lkey C.int) int {
+	L := state.L
+	v := view.value
+	if v.Kind() == reflect.Slice {
+		ltype := C.lua_type(L, lkey)
+		if ltype != C.LUA_TNUMBER {
+			panic(fmt.Sprintf("index of slice must be a number type, here got `%v'", luaTypeName(ltype)))
+		}
+		idx := int(C.lua_tointeger(L, lkey)) - state.VM.indexBaseOf(v.Type())
+		if idx < 0 || idx >= v.Len() {
+			C.lua_pushnil(L)
+			return 1
+		}
+		state.pushReadOnly(v.Index(idx))
+		return 1
+	}
+	keyType := v.Type().Key()
+	key, err := state.luaToGoValue(int(lkey), &keyType)
+	if err != nil {
+		panic(fmt.Sprintf("index type of map must be type `%v', %s", keyType.Kind(), err.Error()))
+	}
+	value := v.MapIndex(key)
+	if !value.IsValid() {
+		C.lua_pushnil(L)
+		return 1
+	}
+	state.pushReadOnly(value)
+	return 1
+}
+
+//
+// golang.ReadOnly(obj) is a read-only view of a go map or slice
+//
+func luaReadOnly(state State) int {
+	obj, ok := state.goObjectAt(2)
+	if !ok {
+		return pushNilAndError(state.L, "ReadOnly() only apply to `map' or `slice'")
+	}
+	view := ReadOnly(obj)
+	if _, ok := view.(*readOnlyView); !ok {
+		return pushNilAndError(state.L, "ReadOnly() only apply to `map' or `slice'")
+	}
+	state.pushObjToLua(view)
+	return 1
+}
@@ -0,0 +1,124 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type policyAccount struct {
+	Name     string
+	Password string
+	Balance  int
+}
+
+func (a *policyAccount) Owner() string {
+	return a.Name
+}
+
+func (a *policyAccount) Delete() {
+	a.Name = ""
+}
+
+func TestLua_typePolicy(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	account := &policyAccount{Name: "jerry", Password: "secret", Balance: 10}
+	r.vm.AddFunc("policy.account", func() *policyAccount { return account })
+	err := r.vm.SetTypePolicy(reflect.TypeOf(account), Policy{
+		AllowMethods: []string{"Owner"},
+		DenyFields:   []string{"Password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := r.E(`
+		local a = policy.account()
+		a.Balance = a.Balance + 5
+		local ok1, err1 = pcall(function() return a.Password end)
+		local ok2, err2 = pcall(function() a.Password = "x" end)
+		local ok3, err3 = pcall(function() a:Delete() end)
+		return a:Owner(), ok1, err1, ok2, ok3, err3
+	`)
+	r.AssertEqual(result[0], "jerry")
+	r.AssertEqual(result[1], false)
+	if !strings.Contains(result[2].(string), "field `Password' of `lua.policyAccount' is not accessible") {
+		t.Errorf("unexpected error %v", result[2])
+	}
+	r.AssertEqual(result[3], false)
+	r.AssertEqual(result[4], false)
+	if !strings.Contains(result[5].(string), "method `Delete' of `lua.policyAccount' is not allowed") {
+		t.Errorf("unexpected error %v", result[5])
+	}
+	r.AssertEqual(account.Balance, 15)
+	r.AssertEqual(account.Name, "jerry")
+
+	r.vm.SetTypePolicy(reflect.TypeOf(account), Policy{ReadOnly: true})
+	r.E_MustError(`policy.account().Balance = 0`)
+	r.E_MustError(`golang.Set(policy.account(), "Balance", 0)`)
+	r.AssertEqual(account.Balance, 15)
+	r.E(`policy.account():Delete()`)
+	r.AssertEqual(account.Name, "")
+
+	// read-only reaches into maps and slices
+	type holder struct {
+		Items []int
+		M     map[string]int
+	}
+	h := &holder{Items: []int{1, 2}, M: map[string]int{"a": 1}}
+	r.vm.AddFunc("policy.holder", func() *holder { return h })
+	r.vm.SetTypePolicy(reflect.TypeOf(h), Policy{ReadOnly: true})
+	result = r.E(`
+		local h = policy.holder()
+		return h.Items[1], h.M.a, #h.Items
+	`)
+	r.AssertEqual(result, []interface{}{2.0, 1.0, 2.0})
+	r.E_MustError(`policy.holder().Items[1] = 99`)
+	r.E_MustError(`policy.holder().M.a = 99`)
+	r.AssertEqual(h.Items, []int{1, 2})
+	r.AssertEqual(h.M, map[string]int{"a": 1})
+
+	if err := r.vm.SetTypePolicy(reflect.TypeOf(0), Policy{}); err == nil {
+		t.Errorf("SetTypePolicy must fail on non struct types")
+	}
+}
+
+func TestLua_readOnly(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	m := map[string][]int{"a": {1, 2, 3}}
+	r.vm.AddFunc("policy.map", func() interface{} { return ReadOnly(m) })
+	r.vm.AddFunc("policy.sum", func(s []int) int {
+		n := 0
+		for _, x := range s {
+			n += x
+		}
+		return n
+	})
+
+	result := r.E(`
+		local m = golang.ReadOnly(golang.MakeMap("string", "int"))
+		local ro = policy.map()
+		local s = ro.a
+		return s[1], #s, golang.Len(ro), policy.sum(s), golang.HasKey(ro, "a"),
+			golang.Len(golang.Sub(s, 1, 3)), golang.Len(m)
+	`)
+	r.AssertEqual(result, []interface{}{2.0, 3.0, 1.0, 6.0, true, 2.0, 0.0})
+
+	r.E_MustError(`policy.map().b = golang.MakeSlice("[]int", 0)`)
+	r.E_MustError(`policy.map().a[0] = 5`)
+	r.E_MustError(`golang.Sub(policy.map().a, 0, 1)[0] = 5`)
+	r.E_MustError(`golang.ToTable(policy.map()).a[1] = 7`)
+	result = r.E(`return golang.ToTable(policy.map().a)[2]`)
+	r.AssertEqual(result[0], 2.0)
+	result = r.E(`return golang.Delete(policy.map(), "a")`)
+	r.AssertEqual(result[0], false)
+	r.AssertEqual(m, map[string][]int{"a": {1, 2, 3}})
+}
@@ -0,0 +1,310 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+
+static int clua_getinfoSln(lua_State *L, lua_Debug *ar) {
+	return lua_getinfo(L, "Sln", ar);
+}
+*/
+import "C"
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+)
+
+//
+// instructions between two samples of the profiler
+//
+const defaultProfileRate = 1000
+
+type profFunc struct {
+	name string
+	file string
+	line int
+}
+
+type profLoc struct {
+	fn   uint64
+	line int
+}
+
+type profSample struct {
+	locs  []uint64
+	count int64
+	nanos int64
+}
+
+type profiler struct {
+	w      io.Writer
+	period int
+	start  time.Time
+	last   time.Time
+
+	funcs   map[profFunc]uint64
+	funcTbl []profFunc
+	locs    map[profLoc]uint64
+	locTbl  []profLoc
+	samples map[string]*profSample
+	order   []*profSample
+}
+
+//
+// set the number of lua instructions between two samples of the
+// profiler, it takes effect at the next StartProfile
+//
+func (vm *VM) SetProfileRate(instructions int) {
+	vm.profileRate = instructions
+}
+
+//
+// start profiling the lua code run by vm, the profile is written to w
+// by StopProfile in the gzipped protobuf format of pprof, e.g.
+//
+//	go tool pprof -top lua.prof
+//
+// Each sample is weighted by the time since the previous one, time in go
+// functions called from lua is attributed to them.
+//
+func (vm *VM) StartProfile(w io.Writer) error {
+	if vm.profiler != nil {
+		return errors.New("lua profiling already in use")
+	}
+	period := vm.profileRate
+	if period <= 0 {
+		period = defaultProfileRate
+	}
+	now := time.Now()
+	vm.profiler = &profiler{
+		w:       w,
+		period:  period,
+		start:   now,
+		last:    now,
+		funcs:   make(map[profFunc]uint64),
+		locs:    make(map[profLoc]uint64),
+		samples: make(map[string]*profSample),
+	}
+	vm.updateHook()
+	return nil
+}
+
+//
+// stop profiling and write the profile
+//
+func (vm *VM) StopProfile() error {
+	p := vm.profiler
+	if p == nil {
+		return errors.New("lua profiling not started")
+	}
+	vm.profiler = nil
+	vm.updateHook()
+
+	gz := gzip.NewWriter(p.w)
+	if _, err := gz.Write(p.encode(time.Now())); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (p *profiler) funcID(fn profFunc) uint64 {
+	if id, ok := p.funcs[fn]; ok {
+		return id
+	}
+	p.funcTbl = append(p.funcTbl, fn)
+	id := uint64(len(p.funcTbl))
+	p.funcs[fn] = id
+	return id
+}
+
+func (p *profiler) locID(fn profFunc, line int) uint64 {
+	loc := profLoc{p.funcID(fn), line}
+	if id, ok := p.locs[loc]; ok {
+		return id
+	}
+	p.locTbl = append(p.locTbl, loc)
+	id := uint64(len(p.locTbl))
+	p.locs[loc] = id
+	return id
+}
+
+//
+// name of the function of a stack frame
+//
+func frameName(ar *C.lua_Debug, src string) string {
+	if ar.name != nil {
+		return C.GoString(ar.name)
+	}
+	switch C.GoString(ar.what) {
+	case "main":
+		return "main chunk"
+	case "C":
+		return "?"
+	}
+	return fmt.Sprintf("function <%v:%v>", src, ar.linedefined)
+}
+
+//
+// record the stack of L, weighted by the time since the last sample.
+// goName is the go function returning to lua, it replaces the C frame
+// calling it.
+//
+func (p *profiler) sample(state State, goName string) {
+	L := state.L
+	now := time.Now()
+	elapsed := now.Sub(p.last)
+	p.last = now
+
+	var locs []uint64
+	var ar C.lua_Debug
+	level := 0
+	if goName != "" {
+		locs = append(locs, p.locID(profFunc{goName, "[go]", 0}, 0))
+		level = 1
+	}
+	for ; C.lua_getstack(L, C.int(level), &ar) != 0; level++ {
+		C.clua_getinfoSln(L, &ar)
+		src := C.GoString(&ar.short_src[0])
+		fn := profFunc{frameName(&ar, src), src, int(ar.linedefined)}
+		line := int(ar.currentline)
+		if line < 0 {
+			line = 0
+		}
+		locs = append(locs, p.locID(fn, line))
+	}
+	if len(locs) == 0 {
+		return
+	}
+
+	var key strings.Builder
+	for _, id := range locs {
+		fmt.Fprintf(&key, "%x,", id)
+	}
+	s, ok := p.samples[key.String()]
+	if !ok {
+		s = &profSample{locs: locs}
+		p.samples[key.String()] = s
+		p.order = append(p.order, s)
+	}
+	s.count++
+	s.nanos += int64(elapsed)
+}
+
+//
+// time a call from lua to the go function fn
+//
+func (p *profiler) callGo(state State, fn reflect.Value) func() {
+	p.sample(state, "")
+	name := "?"
+	if f := runtime.FuncForPC(fn.Pointer()); f != nil {
+		name = f.Name()
+	}
+	return func() {
+		p.sample(state, name)
+	}
+}
+
+//
+// protobuf encoding of the profile, see
+// github.com/google/pprof/proto/profile.proto
+//
+type protoBuf []byte
+
+func (b *protoBuf) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+func (b *protoBuf) uint(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protoBuf) packed(field int, xs []uint64) {
+	var inner protoBuf
+	for _, x := range xs {
+		inner.varint(x)
+	}
+	b.bytes(field, inner)
+}
+
+func (p *profiler) encode(end time.Time) []byte {
+	strs := []string{""}
+	strIdx := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		if i, ok := strIdx[s]; ok {
+			return i
+		}
+		strs = append(strs, s)
+		strIdx[s] = uint64(len(strs) - 1)
+		return strIdx[s]
+	}
+	valueType := func(typ, unit string) []byte {
+		var vt protoBuf
+		vt.uint(1, str(typ))
+		vt.uint(2, str(unit))
+		return vt
+	}
+
+	var b protoBuf
+	b.bytes(1, valueType("samples", "count"))
+	b.bytes(1, valueType("time", "nanoseconds"))
+	for _, s := range p.order {
+		var sb protoBuf
+		sb.packed(1, s.locs)
+		sb.packed(2, []uint64{uint64(s.count), uint64(s.nanos)})
+		b.bytes(2, sb)
+	}
+	for i, loc := range p.locTbl {
+		var line protoBuf
+		line.uint(1, loc.fn)
+		line.uint(2, uint64(loc.line))
+		var lb protoBuf
+		lb.uint(1, uint64(i+1))
+		lb.bytes(4, line)
+		b.bytes(4, lb)
+	}
+	for i, fn := range p.funcTbl {
+		var fb protoBuf
+		fb.uint(1, uint64(i+1))
+		fb.uint(2, str(fn.name))
+		fb.uint(3, str(fn.name))
+		fb.uint(4, str(fn.file))
+		fb.uint(5, uint64(fn.line))
+		b.bytes(5, fb)
+	}
+	// the string table is complete once everything else is encoded
+	var tail protoBuf
+	tail.uint(9, uint64(p.start.UnixNano()))
+	tail.uint(10, uint64(end.Sub(p.start)))
+	tail.bytes(11, valueType("instructions", "count"))
+	tail.uint(12, uint64(p.period))
+	for _, s := range strs {
+		b.bytes(6, []byte(s))
+	}
+	return append(b, tail...)
+}
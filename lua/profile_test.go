@@ -0,0 +1,242 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func profSleep() {
+	time.Sleep(time.Millisecond)
+}
+
+// a field of a protobuf message, x is the value of varints and data the
+// bytes of length-delimited fields
+type protoField struct {
+	num  int
+	x    uint64
+	data []byte
+}
+
+func protoVarint(data []byte) (uint64, []byte, error) {
+	var x uint64
+	for i, b := range data {
+		if i == 10 {
+			break
+		}
+		x |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return x, data[i+1:], nil
+		}
+	}
+	return 0, nil, errors.New("bad varint")
+}
+
+// decode a protobuf message with varint and length-delimited fields only
+func decodeProto(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		key, rest, err := protoVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.x, rest, err = protoVarint(rest)
+		case 2:
+			var n uint64
+			n, rest, err = protoVarint(rest)
+			if err == nil && n > uint64(len(rest)) {
+				err = errors.New("truncated field")
+			}
+			if err == nil {
+				f.data, rest = rest[:n], rest[n:]
+			}
+		default:
+			err = errors.New("unexpected wire type")
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+		data = rest
+	}
+	return fields, nil
+}
+
+func decodePacked(data []byte) ([]uint64, error) {
+	var xs []uint64
+	for len(data) > 0 {
+		x, rest, err := protoVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, x)
+		data = rest
+	}
+	return xs, nil
+}
+
+func TestLua_profile(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.AddFunc("profsleep", profSleep)
+	r.vm.SetProfileRate(100)
+
+	var out bytes.Buffer
+	if err := r.vm.StartProfile(&out); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.vm.StartProfile(&out); err == nil {
+		t.Errorf("a second profile must fail")
+	}
+	r.E(`
+		function hot(n)
+			local s = 0
+			for i = 1, n do
+				s = s + i % 7
+			end
+			return s
+		end
+		hot(100000)
+		for i = 1, 5 do
+			profsleep()
+		end
+	`)
+	if err := r.vm.StopProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.vm.StopProfile(); err == nil {
+		t.Errorf("stopping a stopped profile must fail")
+	}
+
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProfile(t, data, "hot", "main chunk", "goinfi/lua.profSleep")
+}
+
+// check that the profile decodes, that samples refer to known locations
+// and locations to known functions, and that the functions are there
+func checkProfile(t *testing.T, data []byte, funcs ...string) {
+	fields, err := decodeProto(data)
+	if err != nil {
+		t.Fatalf("bad profile: %v", err)
+	}
+	var strs []string
+	var samples, locs, fns [][]byte
+	for _, f := range fields {
+		switch f.num {
+		case 2:
+			samples = append(samples, f.data)
+		case 4:
+			locs = append(locs, f.data)
+		case 5:
+			fns = append(fns, f.data)
+		case 6:
+			strs = append(strs, string(f.data))
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("the string table must start with \"\"")
+	}
+
+	names := map[uint64]string{}
+	for _, fn := range fns {
+		fields, err := decodeProto(fn)
+		if err != nil {
+			t.Fatalf("bad function: %v", err)
+		}
+		var id, name uint64
+		for _, f := range fields {
+			switch f.num {
+			case 1:
+				id = f.x
+			case 2:
+				name = f.x
+			}
+		}
+		if id == 0 || name >= uint64(len(strs)) {
+			t.Fatalf("bad function id %v or name %v", id, name)
+		}
+		names[id] = strs[name]
+	}
+
+	locIDs := map[uint64]bool{}
+	for _, loc := range locs {
+		fields, err := decodeProto(loc)
+		if err != nil {
+			t.Fatalf("bad location: %v", err)
+		}
+		var id uint64
+		for _, f := range fields {
+			switch f.num {
+			case 1:
+				id = f.x
+			case 4:
+				line, err := decodeProto(f.data)
+				if err != nil {
+					t.Fatalf("bad line: %v", err)
+				}
+				for _, lf := range line {
+					if _, ok := names[lf.x]; lf.num == 1 && !ok {
+						t.Errorf("unknown function %v in location %v", lf.x, id)
+					}
+				}
+			}
+		}
+		locIDs[id] = true
+	}
+
+	if len(samples) == 0 {
+		t.Fatalf("no samples in the profile")
+	}
+	for _, sample := range samples {
+		fields, err := decodeProto(sample)
+		if err != nil {
+			t.Fatalf("bad sample: %v", err)
+		}
+		for _, f := range fields {
+			xs, err := decodePacked(f.data)
+			if err != nil {
+				t.Fatalf("bad sample: %v", err)
+			}
+			switch f.num {
+			case 1:
+				for _, id := range xs {
+					if !locIDs[id] {
+						t.Errorf("unknown location %v in sample", id)
+					}
+				}
+			case 2:
+				if len(xs) != 2 {
+					t.Errorf("%v values in sample, want 2", len(xs))
+				}
+			}
+		}
+	}
+
+	found := map[string]bool{}
+	for _, name := range names {
+		found[name] = true
+	}
+	for _, name := range funcs {
+		if !found[name] {
+			t.Errorf("function %q not in the profile", name)
+		}
+	}
+}
@@ -11,7 +11,564 @@ package lua
 #include "clua.h"
 */
 import "C"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+//
+// The stack API of raw functions `func(State) int'. It follows the lua C
+// API, except that errors are go panics which the call of the raw
+// function turns into lua errors. The go function object is at 1 on the
+// stack of a raw function, so its arguments start at 2.
+//
+
+const (
+	LUA_TNONE          = -1
+	LUA_TNIL           = 0
+	LUA_TBOOLEAN       = 1
+	LUA_TLIGHTUSERDATA = 2
+	LUA_TNUMBER        = 3
+	LUA_TSTRING        = 4
+	LUA_TTABLE         = 5
+	LUA_TFUNCTION      = 6
+	LUA_TUSERDATA      = 7
+	LUA_TTHREAD        = 8
+
+	LUA_MULTRET       = -1
+	LUA_REGISTRYINDEX = -10000
+	LUA_ENVIRONINDEX  = -10001
+	LUA_GLOBALSINDEX  = -10002
+)
+
+//
+// an error raised by the stack API, it is passed to lua as it is
+//
+type stateError string
+
+func (state State) Error(msg string) {
+	panic(stateError(msg))
+}
+
+func (state State) Errorf(format string, a ...interface{}) {
+	panic(stateError(fmt.Sprintf(format, a...)))
+}
+
+//
+// raise `bad argument #n (msg)', n counts the arguments from 1
+//
+func (state State) Argerror(idx int, msg string) {
+	state.Errorf("bad argument #%d (%s)", idx-1, msg)
+}
+
+func (state State) typeError(idx int, expected string) {
+	state.Argerror(idx, fmt.Sprintf("%s expected, got %s", expected, state.Typename(idx)))
+}
+
+//
+// basic stack manipulation
+//
+
+func (state State) Gettop() int {
+	return int(C.lua_gettop(state.L))
+}
+
+func (state State) Settop(idx int) {
+	C.lua_settop(state.L, C.int(idx))
+}
+
+func (state State) Pop(n int) {
+	C.lua_settop(state.L, C.int(-n-1))
+}
+
+func (state State) Pushvalue(idx int) {
+	C.lua_pushvalue(state.L, C.int(idx))
+}
+
+func (state State) Insert(idx int) {
+	C.lua_insert(state.L, C.int(idx))
+}
+
+func (state State) Remove(idx int) {
+	C.lua_remove(state.L, C.int(idx))
+}
+
+func (state State) Replace(idx int) {
+	C.lua_replace(state.L, C.int(idx))
+}
+
+func (state State) Checkstack(n int) bool {
+	return C.lua_checkstack(state.L, C.int(n)) != 0
+}
+
+//
+// access functions
+//
+
+func (state State) Type(idx int) int {
+	return int(C.lua_type(state.L, C.int(idx)))
+}
+
+func (state State) Typename(idx int) string {
+	return luaTypeName(C.lua_type(state.L, C.int(idx)))
+}
+
+func (state State) Isnil(idx int) bool {
+	return state.Type(idx) == LUA_TNIL
+}
+
+func (state State) Isnone(idx int) bool {
+	return state.Type(idx) == LUA_TNONE
+}
+
+func (state State) Isnoneornil(idx int) bool {
+	return state.Type(idx) <= LUA_TNIL
+}
+
+func (state State) Isboolean(idx int) bool {
+	return state.Type(idx) == LUA_TBOOLEAN
+}
+
+func (state State) Isnumber(idx int) bool {
+	return C.lua_isnumber(state.L, C.int(idx)) != 0
+}
+
+func (state State) Isstring(idx int) bool {
+	return C.lua_isstring(state.L, C.int(idx)) != 0
+}
+
+func (state State) Istable(idx int) bool {
+	return state.Type(idx) == LUA_TTABLE
+}
+
+func (state State) Isfunction(idx int) bool {
+	return state.Type(idx) == LUA_TFUNCTION
+}
+
+//
+// whether the value at idx is a go object, see Togo
+//
+func (state State) Isgo(idx int) bool {
+	_, ok := state.goObjectAt(idx)
+	return ok
+}
+
+func (state State) Toboolean(idx int) bool {
+	return C.lua_toboolean(state.L, C.int(idx)) != 0
+}
+
+func (state State) Tointeger(idx int) int64 {
+	return int64(C.lua_tointeger(state.L, C.int(idx)))
+}
+
+func (state State) Tonumber(idx int) float64 {
+	return float64(C.lua_tonumber(state.L, C.int(idx)))
+}
+
+//
+// the string at idx, "" if it is neither a string nor a number. Like
+// lua_tostring, a number is converted to a string in place.
+//
+func (state State) Tostring(idx int) string {
+	if !state.Isstring(idx) {
+		return ""
+	}
+	return stringFromLua(state.L, C.int(idx))
+}
+
+//
+// a copy of the bytes of the string at idx
+//
+func (state State) Tobytes(idx int) []byte {
+	var n C.size_t
+	s := C.lua_tolstring(state.L, C.int(idx), &n)
+	if s == nil {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(s), C.int(n))
+}
+
+//
+// the go object of the go userdata at idx, nil if it is not one
+//
+func (state State) Togo(idx int) interface{} {
+	obj, _ := state.goObjectAt(idx)
+	return obj
+}
+
+func (state State) Objlen(idx int) int {
+	return int(C.lua_objlen(state.L, C.int(idx)))
+}
+
+func (state State) Rawequal(idx1, idx2 int) bool {
+	return C.lua_rawequal(state.L, C.int(idx1), C.int(idx2)) != 0
+}
+
+//
+// the value at idx converted to go as the arguments of go functions
+// with the type interface{}
+//
+func (state State) Value(idx int) interface{} {
+	value, err := state.luaToGoValue(idx, &typeOfInterface)
+	if err != nil || !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
+
+//
+// the value at idx converted to the type of *ptr, and stored to it
+//
+func (state State) ValueTo(idx int, ptr interface{}) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("ValueTo needs a non-nil pointer, got `%v'", v.Type())
+	}
+	t := v.Type().Elem()
+	value, err := state.luaToGoValue(idx, &t)
+	if err != nil {
+		return err
+	}
+	if !value.IsValid() {
+		v.Elem().Set(reflect.Zero(t))
+	} else {
+		v.Elem().Set(value)
+	}
+	return nil
+}
+
+//
+// push functions
+//
+
+func (state State) Pushnil() {
+	C.lua_pushnil(state.L)
+}
+
+func (state State) Pushboolean(b bool) {
+	if b {
+		C.lua_pushboolean(state.L, 1)
+	} else {
+		C.lua_pushboolean(state.L, 0)
+	}
+}
+
+func (state State) Pushinteger(n int64) {
+	C.lua_pushinteger(state.L, C.lua_Integer(n))
+}
+
+func (state State) Pushnumber(n float64) {
+	C.lua_pushnumber(state.L, C.lua_Number(n))
+}
 
 func (state State) Pushstring(str string) {
 	pushStringToLua(state.L, str)
 }
+
+func (state State) Pushbytes(bytes []byte) {
+	pushBytesToLua(state.L, bytes)
+}
+
+//
+// push a go value converted as the results of go functions
+//
+func (state State) Push(x interface{}) {
+	if x == nil {
+		C.lua_pushnil(state.L)
+		return
+	}
+	state.goToLuaValue(reflect.ValueOf(x))
+}
+
+//
+// check functions, they raise argument errors
+//
+
+func (state State) Checkany(idx int) {
+	if state.Type(idx) == LUA_TNONE {
+		state.Argerror(idx, "value expected")
+	}
+}
+
+func (state State) Checktype(idx int, ltype int) {
+	if state.Type(idx) != ltype {
+		state.typeError(idx, luaTypeName(C.int(ltype)))
+	}
+}
+
+func (state State) Checkboolean(idx int) bool {
+	if !state.Isboolean(idx) {
+		state.typeError(idx, "boolean")
+	}
+	return state.Toboolean(idx)
+}
+
+func (state State) Checkinteger(idx int) int64 {
+	if !state.Isnumber(idx) {
+		state.typeError(idx, "number")
+	}
+	return state.Tointeger(idx)
+}
+
+func (state State) Checknumber(idx int) float64 {
+	if !state.Isnumber(idx) {
+		state.typeError(idx, "number")
+	}
+	return state.Tonumber(idx)
+}
+
+func (state State) Checkstring(idx int) string {
+	if !state.Isstring(idx) {
+		state.typeError(idx, "string")
+	}
+	return state.Tostring(idx)
+}
+
+func (state State) Checkbytes(idx int) []byte {
+	if !state.Isstring(idx) {
+		state.typeError(idx, "string")
+	}
+	return state.Tobytes(idx)
+}
+
+//
+// the go object at idx, it must be a go object
+//
+func (state State) Checkgo(idx int) interface{} {
+	obj, ok := state.goObjectAt(idx)
+	if !ok {
+		state.typeError(idx, "go object")
+	}
+	return obj
+}
+
+func (state State) Optboolean(idx int, def bool) bool {
+	if state.Isnoneornil(idx) {
+		return def
+	}
+	return state.Checkboolean(idx)
+}
+
+func (state State) Optinteger(idx int, def int64) int64 {
+	if state.Isnoneornil(idx) {
+		return def
+	}
+	return state.Checkinteger(idx)
+}
+
+func (state State) Optnumber(idx int, def float64) float64 {
+	if state.Isnoneornil(idx) {
+		return def
+	}
+	return state.Checknumber(idx)
+}
+
+func (state State) Optstring(idx int, def string) string {
+	if state.Isnoneornil(idx) {
+		return def
+	}
+	return state.Checkstring(idx)
+}
+
+//
+// tables, the non-raw accesses may call metamethods, which must not
+// raise errors, use Pcall with a lua function for them
+//
+
+func (state State) Newtable() {
+	C.lua_createtable(state.L, 0, 0)
+}
+
+func (state State) Createtable(narr, nrec int) {
+	C.lua_createtable(state.L, C.int(narr), C.int(nrec))
+}
+
+func (state State) Gettable(idx int) {
+	state.checkTableCall(C.clua_pgettable(state.L, C.int(idx)))
+}
+
+func (state State) Settable(idx int) {
+	state.checkTableCall(C.clua_psettable(state.L, C.int(idx)))
+}
+
+func (state State) Getfield(idx int, k string) {
+	idx = state.absIndex(idx)
+	pushStringToLua(state.L, k)
+	state.Gettable(idx)
+}
+
+func (state State) Setfield(idx int, k string) {
+	idx = state.absIndex(idx)
+	pushStringToLua(state.L, k)
+	C.lua_insert(state.L, -2)
+	state.Settable(idx)
+}
+
+func (state State) Rawget(idx int) {
+	C.lua_rawget(state.L, C.int(idx))
+}
+
+func (state State) Rawset(idx int) {
+	C.lua_rawset(state.L, C.int(idx))
+}
+
+func (state State) Rawgeti(idx int, n int) {
+	C.lua_rawgeti(state.L, C.int(idx), C.int(n))
+}
+
+func (state State) Rawseti(idx int, n int) {
+	C.lua_rawseti(state.L, C.int(idx), C.int(n))
+}
+
+func (state State) Getglobal(name string) {
+	state.Getfield(LUA_GLOBALSINDEX, name)
+}
+
+func (state State) Setglobal(name string) {
+	state.Setfield(LUA_GLOBALSINDEX, name)
+}
+
+//
+// push t[k] of the table t at idx and the key k, return false when the
+// table is exhausted, see lua_next
+//
+func (state State) Next(idx int) bool {
+	ret := C.clua_pnext(state.L, C.int(idx))
+	if ret < 0 {
+		state.checkTableCall(ret)
+	}
+	return ret != 0
+}
+
+func (state State) Getmetatable(idx int) bool {
+	return C.lua_getmetatable(state.L, C.int(idx)) != 0
+}
+
+func (state State) Setmetatable(idx int) {
+	C.lua_setmetatable(state.L, C.int(idx))
+}
+
+//
+// table access runs in protected mode, as the errors of lua and of the
+// metamethods must not unwind through go. A failed access leaves its
+// error on the stack, which becomes a go panic here.
+//
+func (state State) checkTableCall(ret C.int) {
+	if ret != 0 {
+		msg := state.errorStringAt(-1)
+		C.lua_settop(state.L, -2)
+		state.Error(msg)
+	}
+}
+
+func (state State) absIndex(idx int) int {
+	if idx < 0 && idx > LUA_REGISTRYINDEX {
+		return int(C.lua_gettop(state.L)) + idx + 1
+	}
+	return idx
+}
+
+//
+// calls
+//
+
+//
+// call the function below the nargs arguments on the top of the stack in
+// protected mode, and leave its nresults results. On failure the error
+// is returned and nothing is left.
+//
+func (state State) Pcall(nargs, nresults int) error {
+	L := state.L
+	if C.lua_pcall(L, C.int(nargs), C.int(nresults), 0) != 0 {
+		err := state.errorStringAt(-1)
+		C.lua_settop(L, -2)
+		return errors.New(err)
+	}
+	return nil
+}
+
+//
+// like Pcall, but the error is raised again
+//
+func (state State) Call(nargs, nresults int) {
+	if err := state.Pcall(nargs, nresults); err != nil {
+		state.Error(err.Error())
+	}
+}
+
+//
+// closures
+//
+
+//
+// push a go function as a lua closure with the n values on the top of
+// the stack as its upvalues, which are popped, like lua_pushcclosure.
+// The raw function reads them at Upvalueindex(i).
+//
+func (state State) Pushclosure(fn interface{}, n int) {
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
+		state.Errorf("Pushclosure needs a function, got `%v'", fnType)
+	}
+	if _, err := checkFunc(fnType); err != nil {
+		state.Error(err.Error())
+	}
+	ref := state.VM.newRefNode(fn)
+	C.clua_pushGoClosure(state.L, ref.cptr(), C.int(n))
+}
+
+//
+// make a lua closure of the go function fn with the upvalues, which are
+// converted to lua as the results of go functions. The closure can be
+// passed to lua like other lua functions.
+//
+func (vm *VM) NewClosure(fn interface{}, upvalues ...interface{}) (*Function, error) {
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("NewClosure only apply to function type")
+	}
+	if _, err := checkFunc(fnType); err != nil {
+		return nil, err
+	}
+	L := vm.globalL
+	state := State{vm, L}
+	bottom := C.lua_gettop(L)
+	defer C.lua_settop(L, bottom)
+
+	C.lua_checkstack(L, C.int(len(upvalues)+2))
+	for _, x := range upvalues {
+		state.Push(x)
+	}
+	state.Pushclosure(fn, len(upvalues))
+	return state.NewLuaFunction(-1), nil
+}
+
+//
+// the pseudo index of the upvalue i of the running closure, counted from
+// 1. The go function object is the hidden first upvalue of the closure.
+//
+func (state State) Upvalueindex(i int) int {
+	return LUA_GLOBALSINDEX - i - 1
+}
+
+//
+// upvalues of lua functions, see lua_getupvalue
+//
+
+func (state State) Getupvalue(funcidx, n int) (string, bool) {
+	name := C.lua_getupvalue(state.L, C.int(funcidx), C.int(n))
+	if name == nil {
+		return "", false
+	}
+	return C.GoString(name), true
+}
+
+func (state State) Setupvalue(funcidx, n int) (string, bool) {
+	name := C.lua_setupvalue(state.L, C.int(funcidx), C.int(n))
+	if name == nil {
+		return "", false
+	}
+	return C.GoString(name), true
+}
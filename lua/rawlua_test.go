@@ -0,0 +1,245 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sum(t, [scale]) sums the numbers of the array t
+func rawSum(state State) int {
+	state.Checktype(2, LUA_TTABLE)
+	scale := state.Optnumber(3, 1)
+	sum := 0.0
+	for i := 1; i <= state.Objlen(2); i++ {
+		state.Rawgeti(2, i)
+		sum += state.Tonumber(-1)
+		state.Pop(1)
+	}
+	state.Pushnumber(sum * scale)
+	return 1
+}
+
+// point(x, y) makes {x = x, y = y, name = name or "point"}
+func rawPoint(state State) int {
+	x := state.Checkinteger(2)
+	y := state.Checkinteger(3)
+	name := state.Optstring(4, "point")
+	state.Createtable(0, 3)
+	state.Pushinteger(x)
+	state.Setfield(-2, "x")
+	state.Pushinteger(y)
+	state.Setfield(-2, "y")
+	state.Pushstring(name)
+	state.Setfield(-2, "name")
+	return 1
+}
+
+// apply(f, ...) calls f with the arguments, and returns its results and
+// the go values of the arguments
+func rawApply(state State) int {
+	state.Checktype(2, LUA_TFUNCTION)
+	top := state.Gettop()
+	values := make([]interface{}, 0)
+	for i := 3; i <= top; i++ {
+		values = append(values, state.Value(i))
+	}
+	state.Call(top-2, LUA_MULTRET)
+	state.Push(len(values))
+	return state.Gettop() - 1
+}
+
+// a counter with the raw method add(n) returning an error on negative n
+type rawCounter struct {
+	n int64
+}
+
+func (c *rawCounter) luaAdd(state State) (int, error) {
+	n := state.Checkinteger(3)
+	if n < 0 {
+		return 0, errors.New("negative step")
+	}
+	c.n += n
+	state.Pushinteger(c.n)
+	return 1, nil
+}
+
+func (c *rawCounter) luaMethods() map[string]interface{} {
+	return map[string]interface{}{
+		"add": (*rawCounter).luaAdd,
+	}
+}
+
+func TestLua_rawState(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.AddFunc("raw.sum", rawSum)
+	r.vm.AddFunc("raw.point", rawPoint)
+	r.vm.AddFunc("raw.apply", rawApply)
+	r.vm.AddFunc("raw.fail", func(state State) int {
+		state.Getglobal("failMessage")
+		state.Error(state.Checkstring(-1))
+		return 0
+	})
+
+	result := r.E(`
+		failMessage = "failed"
+		local p = raw.point(1, 2)
+		local ok, err = pcall(raw.fail)
+		return raw.sum({1, 2, 3}), raw.sum({1, 2}, 10), p.x, p.y, p.name, ok, err
+	`)
+	r.AssertEqual(result, []interface{}{6.0, 30.0, 1.0, 2.0, "point", false, "failed"})
+
+	result = r.E(`return raw.apply(function(a, b) return a + b, a * b end, 3, 4)`)
+	r.AssertEqual(result, []interface{}{7.0, 12.0, 2.0})
+
+	for code, msg := range map[string]string{
+		`raw.sum(1)`:               "bad argument #1 (table expected, got number)",
+		`raw.point(1)`:             "bad argument #2 (number expected, got no value)",
+		`raw.point(1, 2, {})`:      "bad argument #3 (string expected, got table)",
+		`raw.apply(error, "oops")`: "oops",
+	} {
+		_, err := r.vm.EvalStringWithError(code)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%v: unexpected error %v", code, err)
+		}
+	}
+}
+
+func TestLua_rawClosure(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	counter, err := r.vm.NewClosure(func(state State) int {
+		n := state.Tointeger(state.Upvalueindex(1)) + state.Optinteger(2, 1)
+		state.Pushinteger(n)
+		state.Pushvalue(-1)
+		state.Replace(state.Upvalueindex(1))
+		state.Pushstring(state.Tostring(state.Upvalueindex(2)))
+		return 2
+	}, 10, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.vm.AddFunc("raw.counter", func() *Function { return counter })
+	r.vm.AddFunc("raw.adder", func(state State) int {
+		state.Pushvalue(2)
+		state.Pushclosure(func(state State) int {
+			state.Pushnumber(state.Tonumber(state.Upvalueindex(1)) + state.Checknumber(2))
+			return 1
+		}, 1)
+		return 1
+	})
+	r.vm.AddFunc("raw.div", func(state State) (int, error) {
+		b := state.Checknumber(3)
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		state.Pushnumber(state.Checknumber(2) / b)
+		return 1, nil
+	})
+
+	result := r.E(`
+		local c = raw.counter()
+		c()
+		local n, name = c(5)
+		local ok, err = pcall(raw.div, 1, 0)
+		return n, name, raw.adder(3)(4), raw.div(6, 3), ok, err
+	`)
+	r.AssertEqual(result, []interface{}{16.0, "counter", 7.0, 2.0, false, "division by zero"})
+
+	r.vm.AddFunc("raw.newCounter", func() *rawCounter { return &rawCounter{} })
+	result = r.E(`
+		local c = raw.newCounter()
+		c:add(2)
+		local ok, err = pcall(c.add, c, -1)
+		return c:add(3), ok, err
+	`)
+	r.AssertEqual(result, []interface{}{5.0, false, "negative step"})
+
+	if _, err := r.vm.NewClosure(func(state State) string { return "" }); err == nil {
+		t.Errorf("NewClosure must fail on bad raw functions")
+	}
+}
+
+func TestLua_rawErrorObject(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var pcallErr error
+	r.vm.AddFunc("raw.pcall", func(state State) int {
+		state.Pushvalue(2)
+		pcallErr = state.Pcall(0, 0)
+		return 0
+	})
+
+	r.E(`raw.pcall(function() error({code = 1}) end)`)
+	if pcallErr == nil || pcallErr.Error() != "(error object is a table value)" {
+		t.Errorf("unexpected Pcall error %v", pcallErr)
+	}
+
+	result := r.E(`return function(e) error(e) end`)
+	fn := result[0].(*Function)
+	for e, msg := range map[interface{}]string{
+		"oops": "oops",
+		42:     "42",
+		true:   "(error object is a boolean value)",
+	} {
+		if _, err := fn.Call(e); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%v: unexpected error %v", e, err)
+		}
+	}
+	if _, err := fn.Call(map[string]int{"code": 1}); err == nil || err.Error() == "" {
+		t.Errorf("unexpected error %v for a table error object", err)
+	}
+}
+
+func TestLua_rawTableErrors(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.AddFunc("newPoint", func() *Point { return &Point{3, 4} })
+	r.vm.AddFunc("raw.getfield", func(state State) int {
+		state.Getfield(2, state.Checkstring(3))
+		return 1
+	})
+	r.vm.AddFunc("raw.setfield", func(state State) int {
+		state.Settop(4)
+		state.Setfield(2, state.Checkstring(3))
+		return 0
+	})
+	r.vm.AddFunc("raw.next", func(state State) int {
+		state.Settop(3)
+		if state.Next(2) {
+			return 2
+		}
+		return 0
+	})
+
+	result := r.E(`
+		failing = setmetatable({}, {__index = function() error("boom") end})
+		local p = newPoint()
+		raw.setfield(p, "X", 5)
+		local ok, err = pcall(raw.getfield, p, "Nope")
+		return raw.getfield(p, "X"), ok, err ~= nil, raw.next({a = 1})
+	`)
+	r.AssertEqual(result, []interface{}{5.0, false, true, "a", 1.0})
+
+	for code, msg := range map[string]string{
+		`raw.getfield(newPoint(), "Nope")`:    "Nope",
+		`raw.setfield(newPoint(), "Nope", 1)`: "Nope",
+		`raw.getfield(nil, "x")`:              "attempt to index a nil value",
+		`raw.getfield(failing, "x")`:          "boom",
+		`raw.next({a = 1}, "zzz")`:            "invalid key to 'next'",
+	} {
+		_, err := r.vm.EvalStringWithError(code)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%v: unexpected error %v", code, err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+
+static int clua_getinfoSnapshot(lua_State *L, lua_Debug *ar) {
+	return lua_getinfo(L, "Slnf", ar);
+}
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+//
+// bounds of the values captured by error snapshots
+//
+const (
+	MAX_SNAPSHOT_FRAMES  = 32
+	MAX_SNAPSHOT_ENTRIES = 32  // per table, slice, map or struct
+	MAX_SNAPSHOT_STRING  = 256 // bytes
+)
+
+//
+// LuaError is the error of a failed lua call when error snapshots are
+// enabled, it holds the stack of lua at the point of the error and can
+// be marshaled to JSON
+//
+type LuaError struct {
+	Message string       `json:"message"`
+	Frames  []ErrorFrame `json:"frames"`
+}
+
+type ErrorFrame struct {
+	Function string     `json:"function"`
+	Source   string     `json:"source"`
+	Line     int        `json:"line"`
+	Locals   []ErrorVar `json:"locals,omitempty"`
+	Upvalues []ErrorVar `json:"upvalues,omitempty"`
+}
+
+//
+// a variable of a frame, tables and go values are converted to maps and
+// slices up to the depth given to SetErrorSnapshots, deeper values and
+// values which are not data, like functions, are strings
+//
+type ErrorVar struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func (e *LuaError) Error() string {
+	return e.Message
+}
+
+//
+// capture a snapshot of the stack when a call from go to lua fails,
+// tables and go values are converted depth levels deep. Depth 0 disables
+// the snapshots.
+//
+func (vm *VM) SetErrorSnapshots(depth int) {
+	vm.snapshotDepth = depth
+}
+
+func (vm *VM) takeSnapshot(msg string) error {
+	snapshot := vm.snapshot
+	vm.snapshot = nil
+	if snapshot == nil {
+		return errors.New(msg)
+	}
+	snapshot.Message = msg
+	return snapshot
+}
+
+//
+// lua_pcall takes only lua functions as error handler, the go handler
+// is called by a lua closure passing the error through
+//
+const luaSnapshotHandler = `
+local capture = ...
+return function(err)
+	capture()
+	return err
+end
+`
+
+func (state State) pushSnapshotHandler() {
+	L := state.L
+	vm := state.VM
+	if vm.snapshotRef == 0 {
+		s, n := stringToC(luaSnapshotHandler)
+		C.luaL_loadbuffer(L, s, n, nil)
+		state.pushObjToLua(captureSnapshot)
+		C.lua_call(L, 1, 1)
+		vm.snapshotRef = C.luaL_ref(L, C.LUA_REGISTRYINDEX)
+	}
+	C.lua_rawgeti(L, C.LUA_REGISTRYINDEX, vm.snapshotRef)
+}
+
+func captureSnapshot(state State) int {
+	state.VM.snapshot = state.captureStack()
+	return 0
+}
+
+func (state State) captureStack() *LuaError {
+	L := state.L
+	depth := state.VM.snapshotDepth
+	snapshot := &LuaError{}
+	var ar C.lua_Debug
+	// level 0 is the go handler, level 1 the lua closure calling it
+	for level := 2; len(snapshot.Frames) < MAX_SNAPSHOT_FRAMES; level++ {
+		if C.lua_getstack(L, C.int(level), &ar) == 0 {
+			break
+		}
+		C.clua_getinfoSnapshot(L, &ar)
+		src := C.GoString(&ar.short_src[0])
+		frame := ErrorFrame{
+			Function: frameName(&ar, src),
+			Source:   src,
+			Line:     int(ar.currentline),
+		}
+		for i := 1; ; i++ {
+			cname := C.lua_getlocal(L, &ar, C.int(i))
+			if cname == nil {
+				break
+			}
+			if name := C.GoString(cname); !strings.HasPrefix(name, "(") {
+				frame.Locals = append(frame.Locals, ErrorVar{name, state.snapshotValue(-1, depth)})
+			}
+			C.lua_settop(L, -2)
+		}
+		// the function pushed by lua_getinfo
+		for i := 1; ; i++ {
+			cname := C.lua_getupvalue(L, -1, C.int(i))
+			if cname == nil {
+				break
+			}
+			frame.Upvalues = append(frame.Upvalues, ErrorVar{C.GoString(cname), state.snapshotValue(-1, depth)})
+			C.lua_settop(L, -2)
+		}
+		C.lua_settop(L, -2)
+		snapshot.Frames = append(snapshot.Frames, frame)
+	}
+	return snapshot
+}
+
+func truncateString(s string) string {
+	if len(s) > MAX_SNAPSHOT_STRING {
+		return s[:MAX_SNAPSHOT_STRING] + "..."
+	}
+	return s
+}
+
+//
+// convert the lua value at idx, depth levels of tables deep
+//
+func (state State) snapshotValue(idx C.int, depth int) interface{} {
+	L := state.L
+	ltype := C.lua_type(L, idx)
+	switch ltype {
+	case C.LUA_TNIL:
+		return nil
+	case C.LUA_TBOOLEAN:
+		return C.lua_toboolean(L, idx) != 0
+	case C.LUA_TNUMBER:
+		n := float64(C.lua_tonumber(L, idx))
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return fmt.Sprint(n)
+		}
+		return n
+	case C.LUA_TSTRING:
+		return truncateString(stringFromLua(L, idx))
+	case C.LUA_TTABLE:
+		if depth <= 0 {
+			break
+		}
+		if idx < 0 {
+			idx = C.lua_gettop(L) + idx + 1
+		}
+		table := make(map[string]interface{})
+		C.lua_pushnil(L)
+		for C.lua_next(L, idx) != 0 {
+			if len(table) >= MAX_SNAPSHOT_ENTRIES {
+				C.lua_settop(L, -3)
+				break
+			}
+			key := fmt.Sprint(state.snapshotValue(-2, 0))
+			table[key] = state.snapshotValue(-1, depth-1)
+			C.lua_settop(L, -2)
+		}
+		return table
+	case C.LUA_TUSERDATA:
+		if obj, ok := state.goObjectAt(int(idx)); ok {
+			return state.snapshotGoValue(reflect.ValueOf(obj), depth)
+		}
+	}
+	return fmt.Sprintf("%v: %p", luaTypeName(ltype), C.lua_topointer(L, idx))
+}
+
+//
+// convert a go value, structs through the fields seen by lua
+//
+func (state State) snapshotGoValue(value reflect.Value, depth int) interface{} {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		return value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint()
+	case reflect.Float32, reflect.Float64:
+		if f := value.Float(); !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	case reflect.String:
+		return truncateString(value.String())
+	}
+	if depth > 0 {
+		switch value.Kind() {
+		case reflect.Struct:
+			sinfo := state.VM.registerStruct(value.Type())
+			result := make(map[string]interface{})
+			for name, fld := range sinfo.fields {
+				if fld.typ == DATA_FIELD && len(result) < MAX_SNAPSHOT_ENTRIES {
+					result[name] = state.snapshotGoValue(value.FieldByIndex(fld.dataIndex), depth-1)
+				}
+			}
+			return result
+		case reflect.Slice, reflect.Array:
+			if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+				return truncateString(string(value.Bytes()))
+			}
+			result := make([]interface{}, 0, value.Len())
+			for i := 0; i < value.Len() && i < MAX_SNAPSHOT_ENTRIES; i++ {
+				result = append(result, state.snapshotGoValue(value.Index(i), depth-1))
+			}
+			return result
+		case reflect.Map:
+			result := make(map[string]interface{})
+			iter := value.MapRange()
+			for iter.Next() && len(result) < MAX_SNAPSHOT_ENTRIES {
+				result[fmt.Sprint(iter.Key().Interface())] = state.snapshotGoValue(iter.Value(), depth-1)
+			}
+			return result
+		}
+	}
+	if value.CanInterface() {
+		return truncateString(fmt.Sprintf("%v", value.Interface()))
+	}
+	return value.Type().String()
+}
@@ -0,0 +1,94 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type snapshotOrder struct {
+	ID    int
+	Items []string
+}
+
+func TestLua_errorsnapshot(t *testing.T) {
+	vm := NewVM()
+	defer vm.Close()
+	vm.Openlibs()
+	vm.AddFunc("getorder", func() *snapshotOrder {
+		return &snapshotOrder{7, []string{"a", "b"}}
+	})
+
+	script := `local limit = 10
+local function check(order, opts)
+	local total = order.ID * 2
+	if total > limit then
+		error("too big: " .. total)
+	end
+end
+check(getorder(), {deep = {deeper = {deepest = 1}}, name = "x"})
+`
+	_, err := vm.EvalNamedString("order.lua", script)
+	if _, ok := err.(*LuaError); ok || err == nil {
+		t.Fatalf("snapshots are opt-in: %#v", err)
+	}
+
+	vm.SetErrorSnapshots(2)
+	_, err = vm.EvalNamedString("order.lua", script)
+	lerr, ok := err.(*LuaError)
+	if !ok {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if !strings.Contains(lerr.Error(), "too big: 14") {
+		t.Errorf("unexpected message %q", lerr.Error())
+	}
+
+	var check *ErrorFrame
+	for i := range lerr.Frames {
+		if lerr.Frames[i].Function == "check" {
+			check = &lerr.Frames[i]
+		}
+	}
+	if check == nil || check.Source != "order.lua" || check.Line != 5 {
+		t.Fatalf("no frame of check in %+v", lerr.Frames)
+	}
+	locals := make(map[string]interface{})
+	for _, v := range check.Locals {
+		locals[v.Name] = v.Value
+	}
+	if locals["total"] != 14.0 {
+		t.Errorf("unexpected locals %v", locals)
+	}
+	order := locals["order"].(map[string]interface{})
+	if order["ID"] != int64(7) || len(order["Items"].([]interface{})) != 2 {
+		t.Errorf("unexpected order %v", order)
+	}
+	opts := locals["opts"].(map[string]interface{})
+	if opts["name"] != "x" || !strings.HasPrefix(opts["deep"].(map[string]interface{})["deeper"].(string), "table: ") {
+		t.Errorf("the depth of tables must be bounded: %v", opts)
+	}
+	if len(check.Upvalues) != 1 || check.Upvalues[0].Name != "limit" || check.Upvalues[0].Value != 10.0 {
+		t.Errorf("unexpected upvalues %v", check.Upvalues)
+	}
+
+	data, err := json.Marshal(lerr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"function":"check"`) {
+		t.Errorf("unexpected json %s", data)
+	}
+
+	// errors caught by pcall in lua are not captured, and the stack is kept
+	top := vm.EvalString(`return pcall(error, "x")`)
+	if len(top) != 2 || top[0] != false || vm.snapshot != nil {
+		t.Errorf("unexpected pcall result %v", top)
+	}
+	if r := vm.EvalString("return 1, 2"); len(r) != 2 {
+		t.Errorf("unexpected results %v", r)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const MAX_LEAK_STACK_DEPTH = 32
+
+//
+// snapshot of the references between go and lua
+//
+type VMStats struct {
+	GoRefs       int            // go objects kept alive by lua
+	GoRefsByType map[string]int // go objects kept alive by lua, by type
+	LuaRefs      int            // outstanding RefLua handles
+	LuaHeapBytes int            // memory used by the lua state
+	StructTypes  int            // registered struct types
+}
+
+func (vm *VM) Stats() VMStats {
+	stats := VMStats{
+		GoRefsByType: make(map[string]int),
+		LuaRefs:      len(vm.luaRefs),
+		StructTypes:  len(vm.structTbl),
+	}
+	for node := vm.refLink.next; node != nil; node = node.next {
+		stats.GoRefs++
+		stats.GoRefsByType[goRefTypeName(node.obj)]++
+	}
+	if vm.globalL != nil {
+		kbytes := int(C.lua_gc(vm.globalL, C.LUA_GCCOUNT, 0))
+		bytes := int(C.lua_gc(vm.globalL, C.LUA_GCCOUNTB, 0))
+		stats.LuaHeapBytes = kbytes*1024 + bytes
+	}
+	return stats
+}
+
+func goRefTypeName(obj interface{}) string {
+	if obj == nil {
+		return "nil"
+	}
+	return reflect.TypeOf(obj).String()
+}
+
+//
+// a reference still alive, with the stack where it was created
+//
+type RefLeak struct {
+	Kind  string // "go" for go objects held by lua, "lua" for RefLua
+	Type  string
+	Stack string
+}
+
+func (leak RefLeak) String() string {
+	return fmt.Sprintf("%v ref %v created at:\n%v", leak.Kind, leak.Type, leak.Stack)
+}
+
+//
+// record the allocation stack of every reference created from now on,
+// it is slow and only meant for debugging
+//
+func (vm *VM) SetLeakTracking(on bool) {
+	vm.leakTracking = on
+	if on && vm.luaRefStacks == nil {
+		vm.luaRefStacks = make(map[int][]uintptr)
+	}
+}
+
+func (vm *VM) traceStack() []uintptr {
+	if !vm.leakTracking {
+		return nil
+	}
+	pcs := make([]uintptr, MAX_LEAK_STACK_DEPTH)
+	// skip runtime.Callers, traceStack and the ref constructor
+	n := runtime.Callers(3, pcs)
+	return pcs[:n]
+}
+
+func formatStack(pcs []uintptr) string {
+	if len(pcs) == 0 {
+		return "\t(not tracked)\n"
+	}
+	var sb strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&sb, "\t%v\n\t\t%v:%v\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return sb.String()
+}
+
+//
+// list references that are still alive. Stacks are only known for the
+// references created while leak tracking was on
+//
+func (vm *VM) Leaks() []RefLeak {
+	leaks := make([]RefLeak, 0)
+	for node := vm.refLink.next; node != nil; node = node.next {
+		leaks = append(leaks, RefLeak{
+			Kind:  "go",
+			Type:  goRefTypeName(node.obj),
+			Stack: formatStack(node.stack),
+		})
+	}
+	refs := make([]int, 0, len(vm.luaRefs))
+	for ref := range vm.luaRefs {
+		refs = append(refs, ref)
+	}
+	sort.Ints(refs)
+	for _, ref := range refs {
+		leaks = append(leaks, RefLeak{
+			Kind:  "lua",
+			Type:  fmt.Sprintf("registry ref @%v", ref),
+			Stack: formatStack(vm.luaRefStacks[ref]),
+		})
+	}
+	return leaks
+}
@@ -0,0 +1,68 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLua_stats(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.AddStructList(allMyStruct{})
+	r.vm.AddFunc("NewPoint", NewPoint)
+
+	base := r.vm.Stats()
+	r.AssertEqual(base.StructTypes, 3)
+	r.AssertEqual(base.LuaRefs, 0)
+	r.AssertNoEqual(base.LuaHeapBytes, 0)
+
+	result := r.E(`
+		points = { NewPoint(1, 2), NewPoint(3, 4) }
+		return function() end
+	`)
+	stats := r.vm.Stats()
+	r.AssertEqual(stats.GoRefs, base.GoRefs+2)
+	r.AssertEqual(stats.GoRefsByType["*lua.Point"], 2)
+	r.AssertEqual(stats.LuaRefs, 1)
+
+	result[0].(*Function).Release()
+	r.E(`points = nil; collectgarbage('collect')`)
+	stats = r.vm.Stats()
+	r.AssertEqual(stats.GoRefs, base.GoRefs)
+	r.AssertEqual(stats.LuaRefs, 0)
+}
+
+func TestLua_leaktracking(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.SetLeakTracking(true)
+	r.vm.AddFunc("NewIntSlice", NewIntSlice)
+	result := r.E(`
+		slice = NewIntSlice()
+		return {}
+	`)
+	tbl := result[0].(*Table)
+	defer tbl.Release()
+
+	var goLeak, luaLeak *RefLeak
+	leaks := r.vm.Leaks()
+	for i := range leaks {
+		switch {
+		case leaks[i].Type == "[]int":
+			goLeak = &leaks[i]
+		case leaks[i].Kind == "lua":
+			luaLeak = &leaks[i]
+		}
+	}
+	if goLeak == nil || luaLeak == nil {
+		t.Fatalf("leaks not found: %v", leaks)
+	}
+	r.AssertEqual(strings.Contains(goLeak.Stack, "GO_callObject"), true)
+	r.AssertEqual(strings.Contains(luaLeak.Stack, "TestLua_leaktracking"), true)
+}
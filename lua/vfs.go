@@ -0,0 +1,346 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+/*
+#include <stdlib.h>
+#include <lua.h>
+#include <lauxlib.h>
+#include <lualib.h>
+#include "clua.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"unsafe"
+)
+
+//
+// FS is the file system seen by the lua io and os libraries after
+// VM.SetFS. Names are slash separated and relative to the root of the
+// file system. The files returned by OpenFile implement io.Reader,
+// io.Writer and io.Seeker as far as the open flags allow.
+//
+type FS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (io.Closer, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+//
+// a read-only FS on top of a fs.FS, e.g. an embed.FS or a fstest.MapFS
+//
+func ReadOnlyFS(fsys fs.FS) FS {
+	return readOnlyFS{fsys}
+}
+
+func (rfs readOnlyFS) OpenFile(name string, flag int, perm fs.FileMode) (io.Closer, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return rfs.fsys.Open(name)
+}
+
+func (rfs readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (rfs readOnlyFS) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrPermission}
+}
+
+//
+// a writable FS rooted at a directory, see DirFS
+//
+type RootFS struct {
+	root *os.Root
+}
+
+//
+// a writable FS rooted at the directory dir, names can not escape dir,
+// through symbolic links neither. The caller closes it when lua is done
+// with it.
+//
+func DirFS(dir string) (*RootFS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &RootFS{root}, nil
+}
+
+func (dfs *RootFS) OpenFile(name string, flag int, perm fs.FileMode) (io.Closer, error) {
+	return dfs.root.OpenFile(name, flag, perm)
+}
+
+func (dfs *RootFS) Remove(name string) error {
+	return dfs.root.Remove(name)
+}
+
+func (dfs *RootFS) Rename(oldname, newname string) error {
+	return dfs.root.Rename(oldname, newname)
+}
+
+//
+// close the directory, the files already open stay usable
+//
+func (dfs *RootFS) Close() error {
+	return dfs.root.Close()
+}
+
+//
+// make a name from lua relative to the root, a leading slash is the
+// root itself and `..' can not go above it
+//
+func vfsPath(name string) (string, error) {
+	p := path.Clean(strings.TrimLeft(name, "/"))
+	if p == ".." || strings.HasPrefix(p, "../") || !fs.ValidPath(p) {
+		return "", fmt.Errorf("%v: path escapes from the file system", name)
+	}
+	return p, nil
+}
+
+func openFlags(mode string) (int, error) {
+	switch strings.Replace(mode, "b", "", -1) {
+	case "r":
+		return os.O_RDONLY, nil
+	case "w":
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC, nil
+	case "a":
+		return os.O_WRONLY | os.O_CREATE | os.O_APPEND, nil
+	case "r+":
+		return os.O_RDWR, nil
+	case "w+":
+		return os.O_RDWR | os.O_CREATE | os.O_TRUNC, nil
+	case "a+":
+		return os.O_RDWR | os.O_CREATE | os.O_APPEND, nil
+	}
+	return 0, fmt.Errorf("invalid mode `%v'", mode)
+}
+
+type vfsLib struct {
+	fsys FS
+}
+
+func (lib vfsLib) openFile(name string, mode string) (*File, error) {
+	p, err := vfsPath(name)
+	if err != nil {
+		return nil, err
+	}
+	flag, err := openFlags(mode)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := lib.fsys.OpenFile(p, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	f := NewFile(handle)
+	f.owned = true
+	f.setvbuf("full", 4096)
+	return f, nil
+}
+
+//
+// io.open(name [, mode])
+//
+func (lib vfsLib) open(state State) int {
+	L := state.L
+	mode := "r"
+	if C.lua_type(L, 3) == C.LUA_TSTRING {
+		mode = stringFromLua(L, 3)
+	}
+	f, err := lib.openFile(stringFromLua(L, 2), mode)
+	if err != nil {
+		return pushFileResult(L, err)
+	}
+	state.pushObjToLua(f)
+	return 1
+}
+
+//
+// io.lines(name), the file is closed at the end
+//
+func (lib vfsLib) lines(state State) int {
+	L := state.L
+	f, err := lib.openFile(stringFromLua(L, 2), "r")
+	if err != nil {
+		panic(err.Error())
+	}
+	state.pushObjToLua(f.linesIterator(true))
+	return 1
+}
+
+func pushOkOrError(L *C.lua_State, err error) int {
+	if err != nil {
+		return pushFileResult(L, err)
+	}
+	C.lua_pushboolean(L, 1)
+	return 1
+}
+
+func (lib vfsLib) remove(state State) int {
+	L := state.L
+	p, err := vfsPath(stringFromLua(L, 2))
+	if err == nil {
+		err = lib.fsys.Remove(p)
+	}
+	return pushOkOrError(L, err)
+}
+
+func (lib vfsLib) rename(state State) int {
+	L := state.L
+	oldp, err := vfsPath(stringFromLua(L, 2))
+	if err != nil {
+		return pushOkOrError(L, err)
+	}
+	newp, err := vfsPath(stringFromLua(L, 3))
+	if err == nil {
+		err = lib.fsys.Rename(oldp, newp)
+	}
+	return pushOkOrError(L, err)
+}
+
+//
+// loadfile(name) returns the chunk, or nil, message and whether the file
+// is missing
+//
+func (lib vfsLib) loadfile(state State) int {
+	L := state.L
+	name := stringFromLua(L, 2)
+	f, err := lib.openFile(name, "r")
+	if err != nil {
+		C.lua_pushnil(L)
+		pushStringToLua(L, err.Error())
+		C.lua_pushboolean(L, boolToC(errors.Is(err, fs.ErrNotExist)))
+		return 3
+	}
+	defer f.close()
+	data, err := io.ReadAll(f.reader)
+	if err != nil {
+		return pushFileResult(L, err)
+	}
+
+	chunkname := C.CString("@" + name)
+	defer C.free(unsafe.Pointer(chunkname))
+	var s *C.char
+	if len(data) > 0 {
+		s = (*C.char)(unsafe.Pointer(&data[0]))
+	}
+	if C.luaL_loadbuffer(L, s, C.size_t(len(data)), chunkname) != 0 {
+		C.lua_pushnil(L)
+		C.lua_insert(L, -2)
+		return 2
+	}
+	return 1
+}
+
+func boolToC(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+const luaVFSSetup = `
+local open, lines, remove, rename, loadfs = ...
+local error, select, type = error, select, type
+
+loadfile = function(name)
+	local fn, err = loadfs(name)
+	return fn, err
+end
+dofile = function(name)
+	local fn, err = loadfs(name)
+	if not fn then
+		error(err, 2)
+	end
+	return fn()
+end
+
+if io then
+	local io_lines = io.lines
+	io.open = open
+	io.lines = function(name)
+		if name == nil then
+			return io_lines()
+		end
+		return lines(name)
+	end
+	io.popen = nil
+	local io_input, io_output = io.input, io.output
+	io.input = function(f)
+		if type(f) == 'string' then
+			error("io.input: file names are not supported by the virtual file system", 2)
+		end
+		return io_input(f)
+	end
+	io.output = function(f)
+		if type(f) == 'string' then
+			error("io.output: file names are not supported by the virtual file system", 2)
+		end
+		return io_output(f)
+	end
+end
+
+if os then
+	os.remove = remove
+	os.rename = rename
+	os.tmpname = nil
+	os.execute = nil
+	os.exit = nil
+	os.getenv = nil
+end
+
+-- debug.getupvalue reaches the host functions wrapped above
+debug = nil
+if package then
+	package.loaded.debug = nil
+	package.loadlib = nil
+end
+
+if package and package.loaders then
+	package.loaders[2] = function(name)
+		local fname = name:gsub('%.', '/')
+		local msg = ''
+		for template in package.path:gmatch('[^;]+') do
+			local path = template:gsub('%?', fname)
+			local fn, err, missing = loadfs(path)
+			if fn then
+				return fn
+			end
+			if not missing then
+				error(err, 3)
+			end
+			msg = msg .. "\n\tno file '" .. path .. "'"
+		end
+		return msg
+	end
+	package.loaders[3] = nil
+	package.loaders[4] = nil
+end
+`
+
+//
+// run the lua io and os libraries, loadfile, dofile and require on fsys
+// instead of the disk of the host. io.popen, os.tmpname, os.execute,
+// os.exit, os.getenv, package.loadlib and the debug library are removed,
+// and require does not search C modules anymore. It must be called after
+// Openlibs.
+//
+func (vm *VM) SetFS(fsys FS) error {
+	lib := vfsLib{fsys}
+	return vm.evalWithArgs(luaVFSSetup, lib.open, lib.lines, lib.remove, lib.rename, lib.loadfile)
+}
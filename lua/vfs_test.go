@@ -0,0 +1,122 @@
+// Copyright 2013 Jerry Hongy.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLua_readonlyfs(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	var result []interface{}
+	var expect []interface{}
+
+	r.vm.SetFS(ReadOnlyFS(fstest.MapFS{
+		"data/a.txt":  {Data: []byte("line1\nline2\n42 3.5\nrest")},
+		"lib/mod.lua": {Data: []byte("return { name = 'mod' }")},
+		"bad.lua":     {Data: []byte("return +")},
+	}))
+
+	result = r.E(`
+		local f = assert(io.open("/data/a.txt"))
+		local l1, l2 = f:read("*l", "*l")
+		local n1, n2 = f:read("*n", "*n")
+		local rest = f:read("*a")
+		local eof = f:read("*l")
+		f:close()
+		return l1, l2, n1, n2, rest, eof
+	`)
+	expect = []interface{}{"line1", "line2", 42.0, 3.5, "\nrest", nil}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		local t = {}
+		for line in io.lines("data/../data/a.txt") do
+			t[#t+1] = line
+		end
+		local f = io.open("data/a.txt")
+		local first = f:read(3)
+		f:seek("set", 1)
+		local again = f:read(2)
+		f:close()
+		return #t, t[4], first, again
+	`)
+	expect = []interface{}{4.0, "rest", "lin", "in"}
+	r.AssertEqual(result, expect)
+
+	result = r.E(`
+		package.path = "lib/?.lua"
+		local mod = require("mod")
+		local w, werr = io.open("data/b.txt", "w")
+		local e, eerr = io.open("../etc/passwd")
+		local ok = os.remove("data/a.txt")
+		return mod.name, w, e, ok, io.popen
+	`)
+	expect = []interface{}{"mod", nil, nil, nil, nil}
+	r.AssertEqual(result, expect)
+
+	r.E_MustError(`dofile("bad.lua")`)
+	r.E_MustError(`dofile("missing.lua")`)
+	r.E_MustError(`io.lines("/../a.txt")`)
+	r.E_MustError(`local f = io.open("data/a.txt"); f:close(); f:read()`)
+}
+
+func TestLua_dirfs(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	dir := t.TempDir()
+	fsys, err := DirFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.vm.SetFS(fsys)
+
+	result := r.E(`
+		local f = assert(io.open("out.txt", "w"))
+		f:write("hello ", 1, "\n"):write("world\n")
+		f:close()
+		assert(os.rename("out.txt", "/moved.txt"))
+		f = assert(io.open("moved.txt", "a+"))
+		f:write("more\n")
+		f:seek("set")
+		local first = f:read("*l")
+		f:close()
+		return first
+	`)
+	r.AssertEqual(result, []interface{}{"hello 1"})
+
+	data, err := os.ReadFile(filepath.Join(dir, "moved.txt"))
+	r.AssertEqual(err, nil)
+	r.AssertEqual(string(data), "hello 1\nworld\nmore\n")
+
+	result = r.E(`
+		assert(os.remove("moved.txt"))
+		return io.open("moved.txt")
+	`)
+	r.AssertEqual(result[0], nil)
+
+	r.AssertEqual(fsys.Close(), nil)
+	result = r.E(`return io.open("new.txt", "w")`)
+	r.AssertEqual(result[0], nil)
+}
+
+func TestLua_vfsSandbox(t *testing.T) {
+	r := NewRunner(t)
+	defer r.End()
+
+	r.vm.SetFS(ReadOnlyFS(fstest.MapFS{}))
+	result := r.E(`
+		return io.popen, os.tmpname, os.execute, os.exit, os.getenv,
+			package.loadlib, debug, package.loaded.debug, package.loaders[3], package.loaders[4]
+	`)
+	r.AssertEqual(result, make([]interface{}, 10))
+	r.E_MustError(`require "debug"`)
+}